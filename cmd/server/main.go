@@ -2,11 +2,8 @@ package main
 
 import (
 	"context"
-	"database/sql"
-	"fmt"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
@@ -42,21 +39,50 @@ func main() {
 		AdminUser:     cfg.DBAdminUser,
 		AdminPassword: cfg.DBAdminPassword,
 
-		SandboxUser:     cfg.DBSandboxUser,
-		SandboxPassword: cfg.DBSandboxPassword,
-
+		InstanceID:     cfg.InstanceID,
 		BaseDB:         cfg.DBName,
 		InitSQL:        cfg.InitSQL,
+		DatasetsDir:    cfg.DatasetsDir,
 		SessionTimeout: 1 * time.Hour,
+		PoolSize:       cfg.SandboxPoolSize,
+		MaxSnapshots:   cfg.MaxSnapshots,
+		ForkTTL:        cfg.ForkTTL,
+		MaxConnections: cfg.SandboxMaxConnections,
+
+		StatefulIdleTimeout: cfg.StatefulIdleTimeout,
+
+		ReconcileInterval: cfg.ReconcileInterval,
+		OrphanGracePeriod: cfg.OrphanGracePeriod,
+
+		Limits: db.Limits{
+			StatementTimeout:         cfg.SandboxStatementTimeout,
+			LockTimeout:              cfg.SandboxLockTimeout,
+			IdleInTransactionTimeout: cfg.SandboxIdleInTxTimeout,
+			WorkMem:                  cfg.SandboxWorkMem,
+			TempFileLimit:            cfg.SandboxTempFileLimit,
+		},
 	})
 	slog.Info("sandbox database manager initialized")
 
-	h := handler.NewHandler(sandbox)
+	h := handler.NewHandler(sandbox, handler.Options{
+		MaxRows:  cfg.QueryMaxRows,
+		MaxBytes: cfg.QueryMaxBytes,
+	})
 
 	// Routes
 	http.Handle("/", http.FileServer(http.Dir("./frontend")))
 	http.HandleFunc("/api/session", h.CreateSession)
+	http.HandleFunc("/api/session/reset", h.ResetSession)
+	http.HandleFunc("/api/session/fork", h.ForkSession)
+	http.HandleFunc("/api/session/stateful", h.SetStateful)
+	http.HandleFunc("/api/snapshots", h.Snapshots)
+	http.HandleFunc("/api/snapshots/restore", h.RestoreSnapshot)
+	http.HandleFunc("/api/datasets", h.ListDatasets)
 	http.HandleFunc("/api/query", h.RunQuery)
+	http.HandleFunc("/api/query/cancel", h.CancelQuery)
+	http.HandleFunc("/api/explain", h.Explain)
+	http.HandleFunc("/api/schema", h.GetSchema)
+	http.HandleFunc("/api/schema/erd", h.GetSchemaDiagram)
 	http.HandleFunc("/api/logout", h.Logout)
 	http.HandleFunc("/api/health", h.HealthCheck)
 
@@ -89,47 +115,8 @@ func main() {
 		slog.Error("HTTP server shutdown error", "error", err)
 	}
 
-	// Drop all sandbox databases
-	dropSandboxDatabases(cfg)
+	// Session sandboxes are kept, the next start restores them
+	sandbox.Close()
 
 	slog.Info("Server shutdown complete")
 }
-
-func dropSandboxDatabases(cfg *config.Config) {
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=postgres sslmode=disable",
-		cfg.DBHost, cfg.DBPort, cfg.DBAdminUser, cfg.DBAdminPassword,
-	)
-	dbConn, err := sql.Open("postgres", connStr)
-	if err != nil {
-		slog.Error("Failed to connect to Postgres", "error", err)
-		return
-	}
-	defer dbConn.Close()
-
-	rows, err := dbConn.Query(`SELECT datname FROM pg_database WHERE datistemplate = false`)
-	if err != nil {
-		slog.Error("Failed to query databases", "error", err)
-		return
-	}
-	defer rows.Close()
-
-	var dbsToDrop []string
-	for rows.Next() {
-		var dbName string
-		if err := rows.Scan(&dbName); err != nil {
-			slog.Error("Failed to scan database name", "error", err)
-			continue
-		}
-		if strings.HasPrefix(dbName, "sandbox_") {
-			dbsToDrop = append(dbsToDrop, dbName)
-		}
-	}
-
-	for _, dbName := range dbsToDrop {
-		slog.Info("Dropping database", "dbName", dbName)
-		if _, err := dbConn.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName)); err != nil {
-			slog.Error("Failed to drop database", "dbName", dbName, "error", err)
-		}
-	}
-}
@@ -3,6 +3,9 @@ package config
 import (
 	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,12 +17,36 @@ type Config struct {
 	DBAdminUser     string
 	DBAdminPassword string
 
-	DBSandboxUser     string
-	DBSandboxPassword string
+	InstanceID string // Namespaces this server's sandboxes in a shared cluster
 
 	DBName     string
 	ServerPort string
 	InitSQL    string
+
+	DatasetsDir string // Directory of additional *.sql datasets
+
+	SandboxPoolSize int // Number of pre-provisioned sandboxes kept ready
+	MaxSnapshots    int // Snapshots a session may keep, 0 disables snapshots
+
+	ForkTTL time.Duration // How long a fork token can be redeemed
+
+	SandboxMaxConnections int // Cap on open connections to all sandboxes, 0 for none
+
+	StatefulIdleTimeout time.Duration // How long a stateful session's connection may sit idle
+
+	ReconcileInterval time.Duration // How often orphaned sandboxes are looked for
+	OrphanGracePeriod time.Duration // How long a sandbox may be unowned before it is dropped
+
+	QueryMaxRows  int   // Rows returned per statement, 0 for no limit
+	QueryMaxBytes int64 // Size of the row data of a query response, 0 for no limit
+
+	// Default sandbox resource limits in PostgreSQL syntax, datasets can
+	// override them in their header
+	SandboxStatementTimeout string
+	SandboxLockTimeout      string
+	SandboxIdleInTxTimeout  string
+	SandboxWorkMem          string
+	SandboxTempFileLimit    string
 }
 
 func LoadConfig() *Config {
@@ -36,12 +63,34 @@ func LoadConfig() *Config {
 		DBAdminUser:     getEnv("DB_ADMIN_USER", ""),
 		DBAdminPassword: getEnv("DB_ADMIN_PASSWORD", ""),
 
-		DBSandboxUser:     getEnv("DB_SANDBOX_USER", ""),
-		DBSandboxPassword: getEnv("DB_SANDBOX_PASSWORD", ""),
+		InstanceID: strings.ToLower(getEnv("INSTANCE_ID", "default")),
 
 		DBName:     getEnv("DB_NAME", "querylab"),
 		ServerPort: getEnv("SERVER_PORT", "8080"),
 		InitSQL:    getEnv("INIT_SQL", "init.sql"),
+
+		DatasetsDir: getEnv("DATASETS_DIR", "datasets"),
+
+		SandboxPoolSize: getEnvInt("SANDBOX_POOL_SIZE", 0),
+		MaxSnapshots:    getEnvInt("SANDBOX_MAX_SNAPSHOTS", 3),
+
+		ForkTTL: getEnvDuration("SANDBOX_FORK_TTL", 24*time.Hour),
+
+		SandboxMaxConnections: getEnvInt("SANDBOX_MAX_CONNECTIONS", 100),
+
+		StatefulIdleTimeout: getEnvDuration("STATEFUL_IDLE_TIMEOUT", 5*time.Minute),
+
+		ReconcileInterval: getEnvDuration("SANDBOX_RECONCILE_INTERVAL", 5*time.Minute),
+		OrphanGracePeriod: getEnvDuration("SANDBOX_ORPHAN_GRACE_PERIOD", 10*time.Minute),
+
+		QueryMaxRows:  getEnvInt("QUERY_MAX_ROWS", 1000),
+		QueryMaxBytes: int64(getEnvInt("QUERY_MAX_BYTES", 4<<20)),
+
+		SandboxStatementTimeout: getEnv("SANDBOX_STATEMENT_TIMEOUT", "3s"),
+		SandboxLockTimeout:      getEnv("SANDBOX_LOCK_TIMEOUT", "2s"),
+		SandboxIdleInTxTimeout:  getEnv("SANDBOX_IDLE_IN_TRANSACTION_TIMEOUT", "60s"),
+		SandboxWorkMem:          getEnv("SANDBOX_WORK_MEM", "16MB"),
+		SandboxTempFileLimit:    getEnv("SANDBOX_TEMP_FILE_LIMIT", ""),
 	}
 }
 
@@ -51,3 +100,29 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("invalid integer in environment, using default", "key", key, "value", v)
+		return fallback
+	}
+	return n
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		slog.Warn("invalid duration in environment, using default", "key", key, "value", v)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,55 @@
+-- name: Library
+-- description: Authors, books, members and loans of a small public library
+-- difficulty: intermediate
+CREATE TABLE AUTHOR (
+    Author_id INT NOT NULL,
+    Name VARCHAR(40) NOT NULL,
+    Country VARCHAR(30),
+    PRIMARY KEY (Author_id)
+);
+CREATE TABLE BOOK (
+    Isbn CHAR(13) NOT NULL,
+    Title VARCHAR(60) NOT NULL,
+    Author_id INT NOT NULL,
+    Published_year INT,
+    Copies INT NOT NULL DEFAULT 1,
+    PRIMARY KEY (Isbn),
+    FOREIGN KEY (Author_id) REFERENCES AUTHOR(Author_id)
+);
+CREATE TABLE MEMBER (
+    Member_id INT NOT NULL,
+    Name VARCHAR(40) NOT NULL,
+    Joined DATE NOT NULL,
+    PRIMARY KEY (Member_id)
+);
+CREATE TABLE LOAN (
+    Isbn CHAR(13) NOT NULL,
+    Member_id INT NOT NULL,
+    Loaned_on DATE NOT NULL,
+    Returned_on DATE,
+    PRIMARY KEY (Isbn, Member_id, Loaned_on),
+    FOREIGN KEY (Isbn) REFERENCES BOOK(Isbn),
+    FOREIGN KEY (Member_id) REFERENCES MEMBER(Member_id)
+);
+
+
+INSERT INTO AUTHOR VALUES (1, 'Ursula K. Le Guin', 'USA');
+INSERT INTO AUTHOR VALUES (2, 'Italo Calvino', 'Italy');
+INSERT INTO AUTHOR VALUES (3, 'Chinua Achebe', 'Nigeria');
+INSERT INTO AUTHOR VALUES (4, 'Sadegh Hedayat', 'Iran');
+
+INSERT INTO BOOK VALUES ('9780441478125', 'The Left Hand of Darkness', 1, 1969, 2);
+INSERT INTO BOOK VALUES ('9780060512750', 'The Dispossessed', 1, 1974, 1);
+INSERT INTO BOOK VALUES ('9780156439619', 'Invisible Cities', 2, 1972, 3);
+INSERT INTO BOOK VALUES ('9780385474542', 'Things Fall Apart', 3, 1958, 2);
+INSERT INTO BOOK VALUES ('9780802131805', 'The Blind Owl', 4, 1937, 1);
+
+INSERT INTO MEMBER VALUES (1, 'Sara Ahmadi', DATE'2023-02-11');
+INSERT INTO MEMBER VALUES (2, 'Tom Baker', DATE'2023-09-30');
+INSERT INTO MEMBER VALUES (3, 'Lena Fischer', DATE'2024-01-15');
+
+INSERT INTO LOAN VALUES ('9780441478125', 1, DATE'2024-03-01', DATE'2024-03-20');
+INSERT INTO LOAN VALUES ('9780156439619', 1, DATE'2024-04-02', NULL);
+INSERT INTO LOAN VALUES ('9780385474542', 2, DATE'2024-03-15', DATE'2024-04-01');
+INSERT INTO LOAN VALUES ('9780802131805', 3, DATE'2024-05-05', NULL);
+INSERT INTO LOAN VALUES ('9780441478125', 3, DATE'2024-05-10', NULL);
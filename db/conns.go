@@ -0,0 +1,311 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Queries of a session reuse connections to its sandbox instead of paying
+// a new Postgres handshake each time. Every sandbox gets a small pool of
+// its own, and all of them share a cap on the connections they keep open.
+
+const (
+	// sandboxMaxIdleConns is how many idle connections a sandbox keeps
+	sandboxMaxIdleConns = 2
+
+	// sandboxConnMaxIdleTime closes connections nobody used for a while
+	sandboxConnMaxIdleTime = 5 * time.Minute
+
+	// baseMaxIdleConns is how many idle admin connections to the base
+	// database are kept
+	baseMaxIdleConns = 4
+
+	// adminConnMaxIdleTime closes the admin connection to a sandbox soon
+	// after provisioning, which is when it is needed
+	adminConnMaxIdleTime = time.Minute
+)
+
+// ConnStats describes the sandbox connection cache
+type ConnStats struct {
+	Sandboxes int `json:"sandboxes"`     // sandboxes with a connection pool
+	Open      int `json:"open"`          // open sandbox connections
+	Max       int `json:"max,omitempty"` // cap on open sandbox connections, 0 for none
+}
+
+// connCache holds one connection pool per sandbox database
+type connCache struct {
+	mu    sync.Mutex
+	pools map[string]*cachedPool // keyed by database name
+	admin map[string]*sql.DB     // admin pools of sandboxes and templates, keyed by database name
+
+	// slots holds a token for every open connection, nil without a cap
+	slots chan struct{}
+}
+
+type cachedPool struct {
+	db       *sql.DB
+	lastUsed time.Time
+}
+
+func newConnCache(maxOpen int) *connCache {
+	c := &connCache{pools: make(map[string]*cachedPool), admin: make(map[string]*sql.DB)}
+	if maxOpen > 0 {
+		c.slots = make(chan struct{}, maxOpen)
+	}
+	return c
+}
+
+// Conn borrows a connection to a session's sandbox, logged in as the
+// sandbox's role. Closing it returns it to the pool.
+func (s *SandboxManager) Conn(ctx context.Context, sessionID string) (*sql.Conn, error) {
+	db, err := s.sandboxDB(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return db.Conn(ctx)
+}
+
+// sandboxDB returns the connection pool of a session's sandbox. It is
+// shared, callers must not close it.
+func (s *SandboxManager) sandboxDB(sessionID string) (*sql.DB, error) {
+	creds, ok := s.Credentials(sessionID)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return s.conns.get(creds)
+}
+
+// get returns the pool for a sandbox, creating it on first use
+func (c *connCache) get(creds Credentials) (*sql.DB, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p, ok := c.pools[creds.DBName]; ok {
+		p.lastUsed = time.Now()
+		return p.db, nil
+	}
+
+	connector, err := pq.NewConnector(creds.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	connector.Dialer(&originDialer{})
+	db := sql.OpenDB(&cappedConnector{Connector: connector, cache: c})
+	db.SetMaxOpenConns(sandboxRoleConnLimit)
+	db.SetMaxIdleConns(sandboxMaxIdleConns)
+	db.SetConnMaxIdleTime(sandboxConnMaxIdleTime)
+
+	c.pools[creds.DBName] = &cachedPool{db: db, lastUsed: time.Now()}
+	return db, nil
+}
+
+// adminDB returns the admin pool of a sandbox or template database,
+// creating it on first use, so the steps provisioning a database share
+// one connection. It is shared, callers must not close it.
+func (s *SandboxManager) adminDB(dbName string) (*sql.DB, error) {
+	s.conns.mu.Lock()
+	defer s.conns.mu.Unlock()
+
+	if db, ok := s.conns.admin[dbName]; ok {
+		return db, nil
+	}
+	db, err := s.adminConn(dbName)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxIdleTime(adminConnMaxIdleTime)
+
+	s.conns.admin[dbName] = db
+	return db, nil
+}
+
+// evictConns closes the sandbox and admin pools of a database. Borrowed
+// connections are closed when they are returned. It must run before the
+// database is dropped, copied, renamed or replaced.
+func (s *SandboxManager) evictConns(dbName string) {
+	s.conns.mu.Lock()
+	p, ok := s.conns.pools[dbName]
+	delete(s.conns.pools, dbName)
+	admin, adminOK := s.conns.admin[dbName]
+	delete(s.conns.admin, dbName)
+	s.conns.mu.Unlock()
+
+	if ok {
+		p.db.Close()
+	}
+	if adminOK {
+		admin.Close()
+	}
+}
+
+// acquire takes a slot for a new connection. When the cap is reached it
+// closes idle connections of other sandboxes, least recently used first,
+// then waits for a slot.
+func (c *connCache) acquire(ctx context.Context) error {
+	if c.slots == nil {
+		return nil
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	// Sort copies taken under the lock, get updates lastUsed concurrently
+	c.mu.Lock()
+	pools := make([]cachedPool, 0, len(c.pools))
+	for _, p := range c.pools {
+		pools = append(pools, *p)
+	}
+	c.mu.Unlock()
+	sort.Slice(pools, func(i, j int) bool { return pools[i].lastUsed.Before(pools[j].lastUsed) })
+
+	for _, p := range pools {
+		if p.db.Stats().Idle == 0 {
+			continue
+		}
+		// Shrinking the idle limit closes the idle connections right away
+		p.db.SetMaxIdleConns(0)
+		p.db.SetMaxIdleConns(sandboxMaxIdleConns)
+
+		select {
+		case c.slots <- struct{}{}:
+			return nil
+		default:
+		}
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *connCache) release() {
+	if c.slots != nil {
+		<-c.slots
+	}
+}
+
+// ConnStats reports the state of the sandbox connection cache
+func (s *SandboxManager) ConnStats() ConnStats {
+	s.conns.mu.Lock()
+	defer s.conns.mu.Unlock()
+
+	stats := ConnStats{Sandboxes: len(s.conns.pools), Max: cap(s.conns.slots)}
+	for _, p := range s.conns.pools {
+		stats.Open += p.db.Stats().OpenConnections
+	}
+	return stats
+}
+
+// cappedConnector opens sandbox connections within the cache's cap
+type cappedConnector struct {
+	driver.Connector
+	cache *connCache
+}
+
+func (c *cappedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := c.cache.acquire(ctx); err != nil {
+		return nil, err
+	}
+	origins := &originConn{}
+	conn, err := c.Connector.Connect(context.WithValue(ctx, originKey{}, origins))
+	if err != nil {
+		c.cache.release()
+		return nil, err
+	}
+
+	cc := &cappedConn{Conn: conn, release: sync.OnceFunc(c.cache.release), origins: origins}
+	// lib/pq drops notices unless a handler is set on the connection
+	pq.SetNoticeHandler(conn, cc.notice)
+	return cc, nil
+}
+
+// cappedConn gives its slot back when closed. It passes on the optional
+// interfaces of lib/pq connections, which database/sql looks for.
+type cappedConn struct {
+	driver.Conn
+	release func()
+
+	// onNotice receives the NOTICE, WARNING and other non-error messages
+	// of the statement running on the connection
+	onNotice func(*pq.Error)
+
+	// origins reads the column origins lib/pq drops
+	origins *originConn
+}
+
+// SetNoticeHandler sets the function receiving the notices of the
+// connection, nil discards them. Notices are delivered while a statement
+// runs, on the goroutine running it.
+func (c *cappedConn) SetNoticeHandler(fn func(*pq.Error)) {
+	c.onNotice = fn
+}
+
+func (c *cappedConn) notice(e *pq.Error) {
+	if c.onNotice != nil {
+		c.onNotice(e)
+	}
+}
+
+// RowOrigins returns the table columns the columns of the last result or
+// statement described on the connection come from
+func (c *cappedConn) RowOrigins() []ColumnOrigin {
+	return c.origins.rowOrigins()
+}
+
+func (c *cappedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+func (c *cappedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *cappedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c *cappedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *cappedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *cappedConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *cappedConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+// ResetSession runs before a pooled connection is reused. A connection
+// serves every request of its session, so nothing one request left
+// behind (an open transaction, SET, temp tables) may leak into the next.
+func (c *cappedConn) ResetSession(ctx context.Context) error {
+	if err := c.Conn.(driver.SessionResetter).ResetSession(ctx); err != nil {
+		return err
+	}
+	for _, stmt := range []string{"ROLLBACK", "DISCARD ALL"} {
+		if _, err := c.ExecContext(ctx, stmt, nil); err != nil {
+			return driver.ErrBadConn
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slotConnector opens fake connections holding a slot of the cache, like
+// cappedConnector does for real ones
+type slotConnector struct {
+	cache *connCache
+}
+
+func (c slotConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := c.cache.acquire(ctx); err != nil {
+		return nil, err
+	}
+	return &slotConn{release: sync.OnceFunc(c.cache.release)}, nil
+}
+
+func (c slotConnector) Driver() driver.Driver { return nil }
+
+type slotConn struct {
+	release func()
+}
+
+func (c *slotConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *slotConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *slotConn) Close() error {
+	c.release()
+	return nil
+}
+
+// addPool adds a sandbox pool last used at the given time to the cache
+func addPool(c *connCache, name string, lastUsed time.Time) *sql.DB {
+	db := sql.OpenDB(slotConnector{cache: c})
+	db.SetMaxIdleConns(sandboxMaxIdleConns)
+	c.pools[name] = &cachedPool{db: db, lastUsed: lastUsed}
+	return db
+}
+
+func TestConnCacheSlots(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxOpen int
+		acquire int // slots taken before the last acquire
+		wantErr error
+	}{
+		{"no cap", 0, 10, nil},
+		{"below the cap", 3, 2, nil},
+		{"at the cap", 3, 3, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConnCache(tt.maxOpen)
+			for range tt.acquire {
+				if err := c.acquire(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if err := c.acquire(ctx); err != tt.wantErr {
+				t.Fatalf("acquire() = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+
+			// A released slot goes to the next connection
+			c.release()
+			if err := c.acquire(context.Background()); err != nil {
+				t.Errorf("acquire() after release = %v", err)
+			}
+		})
+	}
+}
+
+func TestConnCacheWaitsForRelease(t *testing.T) {
+	c := newConnCache(1)
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- c.acquire(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("acquire() = %v at the cap, want it to wait", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	c.release()
+	if err := <-done; err != nil {
+		t.Errorf("acquire() after release = %v", err)
+	}
+}
+
+func TestConnCacheClosesIdleConns(t *testing.T) {
+	c := newConnCache(2)
+	now := time.Now()
+	older := addPool(c, "older", now.Add(-time.Minute))
+	newer := addPool(c, "newer", now)
+	defer older.Close()
+	defer newer.Close()
+
+	// One idle connection per sandbox uses up the cap
+	for _, db := range []*sql.DB{older, newer} {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	// A third sandbox gets the slot of the least recently used one
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.acquire(ctx); err != nil {
+		t.Fatalf("acquire() = %v, want an idle connection closed", err)
+	}
+	if open := older.Stats().OpenConnections; open != 0 {
+		t.Errorf("least recently used sandbox has %d open connections, want 0", open)
+	}
+	if open := newer.Stats().OpenConnections; open != 1 {
+		t.Errorf("most recently used sandbox has %d open connections, want 1", open)
+	}
+}
+
+func TestConnCacheKeepsBusyConns(t *testing.T) {
+	c := newConnCache(1)
+	db := addPool(c, "busy", time.Now())
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Borrowed connections aren't closed, the cap holds until one is returned
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("acquire() = %v with every connection busy, want %v", err, context.DeadlineExceeded)
+	}
+	if open := db.Stats().OpenConnections; open != 1 {
+		t.Errorf("busy sandbox has %d open connections, want 1", open)
+	}
+}
+
+func TestConnCacheAcquireWhileUsed(t *testing.T) {
+	c := newConnCache(1)
+	for _, name := range []string{"a", "b"} {
+		defer addPool(c, name, time.Now()).Close()
+	}
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions keep using their sandbox while acquire looks for idle
+	// connections to close; run with -race
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		close(started)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.get(Credentials{DBName: "a"})
+				c.get(Credentials{DBName: "b"})
+			}
+		}
+	}()
+
+	<-started
+	for range 1000 {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c.acquire(ctx)
+	}
+	close(stop)
+	wg.Wait()
+}
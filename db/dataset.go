@@ -0,0 +1,154 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultDatasetID is the ID of the dataset loaded from DBConfig.InitSQL
+const DefaultDatasetID = "default"
+
+// ErrUnknownDataset is returned when a session asks for a dataset that is
+// not in the catalog
+var ErrUnknownDataset = errors.New("unknown dataset")
+
+// Dataset is an SQL file sandboxes can be provisioned from.
+//
+// Metadata is read from "-- key: value" comments at the top of the file:
+//
+//	-- name: Company
+//	-- description: Employees, departments and projects
+//	-- difficulty: beginner
+//
+// Resource limits can be overridden the same way, using the PostgreSQL
+// parameter names, e.g. "-- statement_timeout: 10s".
+type Dataset struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Difficulty  string `json:"difficulty,omitempty"`
+	Default     bool   `json:"default"`
+
+	Path   string `json:"-"`
+	Limits Limits `json:"-"` // Overrides of DBConfig.Limits
+}
+
+// DatasetCatalog holds the datasets users can choose from
+type DatasetCatalog struct {
+	datasets map[string]*Dataset
+	order    []string
+}
+
+// LoadDatasets builds the catalog from the init SQL file, registered as the
+// default dataset, and every *.sql file in dir. A missing dir is not an error.
+func LoadDatasets(initSQL, dir string) (*DatasetCatalog, error) {
+	c := &DatasetCatalog{datasets: make(map[string]*Dataset)}
+
+	def, err := loadDataset(DefaultDatasetID, initSQL)
+	if err != nil {
+		slog.Warn("failed to read default dataset metadata", "file", initSQL, "error", err)
+		def = &Dataset{ID: DefaultDatasetID, Name: DefaultDatasetID, Path: initSQL}
+	}
+	def.Default = true
+	c.add(def)
+
+	if dir == "" {
+		return c, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".sql")
+		if _, exists := c.datasets[id]; exists {
+			slog.Warn("skipping dataset with duplicate id", "id", id, "file", path)
+			continue
+		}
+
+		ds, err := loadDataset(id, path)
+		if err != nil {
+			slog.Warn("skipping unreadable dataset", "file", path, "error", err)
+			continue
+		}
+		c.add(ds)
+	}
+
+	return c, nil
+}
+
+func (c *DatasetCatalog) add(ds *Dataset) {
+	c.datasets[ds.ID] = ds
+	c.order = append(c.order, ds.ID)
+}
+
+// List returns all datasets, the default one first
+func (c *DatasetCatalog) List() []Dataset {
+	out := make([]Dataset, 0, len(c.order))
+	for _, id := range c.order {
+		out = append(out, *c.datasets[id])
+	}
+	return out
+}
+
+// Get returns a dataset by ID, an empty ID resolves to the default dataset
+func (c *DatasetCatalog) Get(id string) (*Dataset, error) {
+	if id == "" {
+		id = DefaultDatasetID
+	}
+	ds, ok := c.datasets[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownDataset, id)
+	}
+	return ds, nil
+}
+
+// loadDataset reads the metadata header of a dataset file
+func loadDataset(id, path string) (*Dataset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ds := &Dataset{ID: id, Name: id, Path: path}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+
+		key, value, ok := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "--")), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "name":
+			ds.Name = value
+		case "description":
+			ds.Description = value
+		case "difficulty":
+			ds.Difficulty = value
+		default:
+			ds.Limits.set(strings.ToLower(strings.TrimSpace(key)), value)
+		}
+	}
+
+	return ds, scanner.Err()
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDatasetHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Dataset
+	}{
+		{
+			name:    "no header",
+			content: "CREATE TABLE t (id int);\n",
+			want:    Dataset{ID: "ds", Name: "ds"},
+		},
+		{
+			name: "metadata",
+			content: "-- name: Library\n" +
+				"-- description: Authors, books: and loans\n" +
+				"--difficulty:intermediate\n" +
+				"CREATE TABLE t (id int);\n",
+			want: Dataset{ID: "ds", Name: "Library", Description: "Authors, books: and loans", Difficulty: "intermediate"},
+		},
+		{
+			name: "keys are case insensitive",
+			content: "-- Name: Company\n" +
+				"-- DIFFICULTY: beginner\n",
+			want: Dataset{ID: "ds", Name: "Company", Difficulty: "beginner"},
+		},
+		{
+			name:    "blank lines and comments without a key",
+			content: "\n-- Sample data\n\n-- name: Shop\n",
+			want:    Dataset{ID: "ds", Name: "Shop"},
+		},
+		{
+			name: "header ends at the first statement",
+			content: "-- name: Shop\n" +
+				"CREATE TABLE t (id int);\n" +
+				"-- description: not part of the header\n",
+			want: Dataset{ID: "ds", Name: "Shop"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, t.TempDir(), "ds.sql", tt.content)
+			got, err := loadDataset("ds", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Path = path
+			if *got != tt.want {
+				t.Errorf("loadDataset() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDatasets(t *testing.T) {
+	dir := t.TempDir()
+	initSQL := writeFile(t, dir, "init.sql", "-- name: Company\nSELECT 1;\n")
+
+	datasetsDir := filepath.Join(dir, "datasets")
+	if err := os.Mkdir(datasetsDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, datasetsDir, "shop.sql", "-- name: Shop\n")
+	writeFile(t, datasetsDir, "library.sql", "-- name: Library\n")
+	writeFile(t, datasetsDir, "default.sql", "-- name: Duplicate\n")
+	writeFile(t, datasetsDir, "notes.txt", "not a dataset")
+
+	c, err := LoadDatasets(initSQL, datasetsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, ds := range c.List() {
+		ids = append(ids, ds.ID)
+	}
+	want := []string{DefaultDatasetID, "library", "shop"}
+	if len(ids) != len(want) {
+		t.Fatalf("List() = %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("List() = %v, want %v", ids, want)
+		}
+	}
+
+	tests := []struct {
+		id          string
+		wantID      string
+		wantName    string
+		wantDefault bool
+		wantErr     error
+	}{
+		{"", DefaultDatasetID, "Company", true, nil},
+		{DefaultDatasetID, DefaultDatasetID, "Company", true, nil},
+		{"library", "library", "Library", false, nil},
+		{"missing", "", "", false, ErrUnknownDataset},
+	}
+	for _, tt := range tests {
+		ds, err := c.Get(tt.id)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("Get(%q) error = %v, want %v", tt.id, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if ds.ID != tt.wantID || ds.Name != tt.wantName || ds.Default != tt.wantDefault {
+			t.Errorf("Get(%q) = %+v, want ID %q, name %q, default %v", tt.id, *ds, tt.wantID, tt.wantName, tt.wantDefault)
+		}
+	}
+}
+
+func TestLoadDatasetsFallbacks(t *testing.T) {
+	dir := t.TempDir()
+
+	// A missing datasets directory leaves only the default dataset, and an
+	// unreadable init SQL file still gives one without metadata
+	c, err := LoadDatasets(filepath.Join(dir, "missing.sql"), filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := c.List()
+	if len(list) != 1 {
+		t.Fatalf("List() has %d datasets, want 1", len(list))
+	}
+	if ds := list[0]; ds.ID != DefaultDatasetID || ds.Name != DefaultDatasetID || !ds.Default {
+		t.Errorf("default dataset = %+v", ds)
+	}
+}
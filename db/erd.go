@@ -0,0 +1,356 @@
+package db
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// ER diagram rendering for a Schema. The diagrams are built from the live
+// catalog, so they include tables the user created during the session.
+
+var mermaidUnsafe = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// mermaidEscaper writes the characters that end or start escapes in a
+// quoted Mermaid label as entity codes
+var mermaidEscaper = strings.NewReplacer(`#`, `#35;`, `"`, `#quot;`, "\n", " ", "\r", " ")
+
+// mermaidIdent turns a name into a Mermaid identifier, using fallback
+// when nothing of the name is left or it would start with a digit
+func mermaidIdent(s, fallback string) string {
+	id := strings.Trim(mermaidUnsafe.ReplaceAllString(s, "_"), "_")
+	switch {
+	case id == "":
+		return fallback
+	case id[0] >= '0' && id[0] <= '9':
+		return fallback + "_" + id
+	}
+	return id
+}
+
+// mermaidEntities names the entity of every table. Names that come out
+// the same, like those of a-b and a_b, get a numeric suffix.
+func (sc *Schema) mermaidEntities() map[string]string {
+	names := make(map[string]string, len(sc.Tables))
+	used := make(map[string]bool, len(sc.Tables))
+	for i := range sc.Tables {
+		qualified := sc.Tables[i].qualifiedName()
+		base := mermaidIdent(qualified, "table")
+		name := base
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d", base, n)
+		}
+		used[name] = true
+		names[qualified] = name
+	}
+	return names
+}
+
+// dotEscaper escapes the characters that are special in a DOT quoted string
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// dotQuote returns s as a DOT quoted string. Unlike Go quoting it keeps
+// non-ASCII characters as they are.
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+// qualifiedName returns the table name, prefixed with its schema unless public
+func (t *Table) qualifiedName() string {
+	if t.Schema == "public" {
+		return t.Name
+	}
+	return t.Schema + "." + t.Name
+}
+
+func refName(fk ForeignKey) string {
+	if fk.RefSchema == "public" {
+		return fk.RefTable
+	}
+	return fk.RefSchema + "." + fk.RefTable
+}
+
+// columnKeys returns the PK/FK markers of every column in a table
+func (t *Table) columnKeys() map[string][]string {
+	keys := make(map[string][]string)
+	for _, col := range t.PrimaryKey {
+		keys[col] = append(keys[col], "PK")
+	}
+	for _, fk := range t.ForeignKeys {
+		for _, col := range fk.Columns {
+			keys[col] = append(keys[col], "FK")
+		}
+	}
+	return keys
+}
+
+// Mermaid renders the schema as a Mermaid erDiagram
+func (sc *Schema) Mermaid() string {
+	entities := sc.mermaidEntities()
+	entity := func(qualified string) string {
+		if name, ok := entities[qualified]; ok {
+			return name
+		}
+		// A referenced table outside the diagram
+		return mermaidIdent(qualified, "table")
+	}
+
+	var b strings.Builder
+	b.WriteString("erDiagram\n")
+
+	for i := range sc.Tables {
+		t := &sc.Tables[i]
+		keys := t.columnKeys()
+
+		fmt.Fprintf(&b, "    %s {\n", entity(t.qualifiedName()))
+		for _, col := range t.Columns {
+			fmt.Fprintf(&b, "        %s %s", mermaidIdent(col.Type, "type"), mermaidIdent(col.Name, "column"))
+			if k := keys[col.Name]; len(k) > 0 {
+				fmt.Fprintf(&b, " %s", strings.Join(k, ", "))
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("    }\n")
+	}
+
+	for i := range sc.Tables {
+		t := &sc.Tables[i]
+		for _, fk := range t.ForeignKeys {
+			fmt.Fprintf(&b, "    %s ||--o{ %s : \"%s\"\n",
+				entity(refName(fk)),
+				entity(t.qualifiedName()),
+				mermaidEscaper.Replace(strings.Join(fk.Columns, ", ")),
+			)
+		}
+	}
+
+	return b.String()
+}
+
+// DOT renders the schema as a Graphviz digraph with one record per table
+func (sc *Schema) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph ER {\n")
+	b.WriteString("    graph [rankdir=LR, fontname=\"Helvetica\"];\n")
+	b.WriteString("    node [shape=plaintext, fontname=\"Helvetica\"];\n")
+	b.WriteString("    edge [arrowhead=crow, arrowtail=none, dir=both, fontname=\"Helvetica\", fontsize=10];\n\n")
+
+	for i := range sc.Tables {
+		t := &sc.Tables[i]
+		keys := t.columnKeys()
+
+		fmt.Fprintf(&b, "    %s [label=<\n", dotQuote(t.qualifiedName()))
+		b.WriteString("        <table border=\"0\" cellborder=\"1\" cellspacing=\"0\" cellpadding=\"4\">\n")
+		fmt.Fprintf(&b, "        <tr><td bgcolor=\"#3498db\"><font color=\"white\"><b>%s</b></font></td></tr>\n",
+			html.EscapeString(t.qualifiedName()))
+		for _, col := range t.Columns {
+			label := html.EscapeString(col.Name + " : " + col.Type)
+			if k := keys[col.Name]; len(k) > 0 {
+				label = "<i>" + strings.Join(k, ",") + "</i> " + label
+			}
+			fmt.Fprintf(&b, "        <tr><td port=\"%s\" align=\"left\">%s</td></tr>\n", html.EscapeString(col.Name), label)
+		}
+		b.WriteString("        </table>\n    >];\n")
+	}
+
+	b.WriteString("\n")
+	for i := range sc.Tables {
+		t := &sc.Tables[i]
+		for _, fk := range t.ForeignKeys {
+			from, to := t.qualifiedName(), refName(fk)
+			if len(fk.Columns) > 0 && len(fk.RefColumns) > 0 {
+				fmt.Fprintf(&b, "    %s:%s -> %s:%s [label=%s];\n",
+					dotQuote(from), dotQuote(fk.Columns[0]), dotQuote(to), dotQuote(fk.RefColumns[0]), dotQuote(fk.Name))
+			} else {
+				fmt.Fprintf(&b, "    %s -> %s [label=%s];\n", dotQuote(from), dotQuote(to), dotQuote(fk.Name))
+			}
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// SVG layout constants, in pixels
+const (
+	svgCharWidth   = 7.2
+	svgRowHeight   = 18
+	svgHeader      = 26
+	svgPadding     = 10
+	svgColumnGap   = 90
+	svgRowGap      = 30
+	svgMargin      = 20
+	svgMinBoxWidth = 140
+)
+
+type svgBox struct {
+	table *Table
+	x, y  float64
+	w, h  float64
+}
+
+// rowY returns the vertical center of a column row, or of the header
+func (b *svgBox) rowY(column string) float64 {
+	for i, col := range b.table.Columns {
+		if col.Name == column {
+			return b.y + svgHeader + float64(i)*svgRowHeight + svgRowHeight/2
+		}
+	}
+	return b.y + svgHeader/2
+}
+
+// SVG renders the schema as a standalone SVG image. Tables are placed in
+// columns by foreign-key depth, so referenced tables appear left of the
+// tables that reference them.
+func (sc *Schema) SVG() string {
+	byName := make(map[string]*Table, len(sc.Tables))
+	for i := range sc.Tables {
+		byName[sc.Tables[i].qualifiedName()] = &sc.Tables[i]
+	}
+
+	// Foreign-key depth of every table, cycles are cut at the first revisit
+	depth := make(map[string]int)
+	visiting := make(map[string]bool)
+	var levelOf func(t *Table) int
+	levelOf = func(t *Table) int {
+		name := t.qualifiedName()
+		if d, ok := depth[name]; ok {
+			return d
+		}
+		if visiting[name] {
+			return 0
+		}
+		visiting[name] = true
+		d := 0
+		for _, fk := range t.ForeignKeys {
+			if ref, ok := byName[refName(fk)]; ok && ref != t {
+				d = max(d, levelOf(ref)+1)
+			}
+		}
+		visiting[name] = false
+		depth[name] = d
+		return d
+	}
+
+	var columns [][]*svgBox
+	boxes := make(map[string]*svgBox, len(sc.Tables))
+	for i := range sc.Tables {
+		t := &sc.Tables[i]
+		level := levelOf(t)
+		for len(columns) <= level {
+			columns = append(columns, nil)
+		}
+
+		width := float64(len(t.qualifiedName()))*svgCharWidth + 2*svgPadding
+		for _, col := range t.Columns {
+			width = math.Max(width, float64(len(col.Name)+len(col.Type)+14)*svgCharWidth+2*svgPadding)
+		}
+		box := &svgBox{
+			table: t,
+			w:     math.Max(width, svgMinBoxWidth),
+			h:     svgHeader + float64(len(t.Columns))*svgRowHeight + svgPadding/2,
+		}
+		columns[level] = append(columns[level], box)
+		boxes[t.qualifiedName()] = box
+	}
+
+	// Place the columns left to right and the boxes top to bottom
+	x := float64(svgMargin)
+	totalW, totalH := 0.0, 0.0
+	for _, col := range columns {
+		y := float64(svgMargin)
+		colW := 0.0
+		for _, box := range col {
+			box.x, box.y = x, y
+			y += box.h + svgRowGap
+			colW = math.Max(colW, box.w)
+		}
+		totalH = math.Max(totalH, y)
+		x += colW + svgColumnGap
+		totalW = x
+	}
+	totalW = math.Max(totalW-svgColumnGap+svgMargin, 2*svgMargin)
+	totalH = math.Max(totalH-svgRowGap+svgMargin, 2*svgMargin)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f" font-family="Helvetica, Arial, sans-serif" font-size="12">`+"\n",
+		totalW, totalH, totalW, totalH)
+	b.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse"><path d="M 0 0 L 10 5 L 0 10 z" fill="#7f8c8d"/></marker></defs>` + "\n")
+
+	// Relationships first so the tables are drawn on top of them
+	for i := range sc.Tables {
+		t := &sc.Tables[i]
+		from := boxes[t.qualifiedName()]
+		for _, fk := range t.ForeignKeys {
+			to, ok := boxes[refName(fk)]
+			if !ok {
+				continue
+			}
+
+			var fromCol, toCol string
+			if len(fk.Columns) > 0 {
+				fromCol = fk.Columns[0]
+			}
+			if len(fk.RefColumns) > 0 {
+				toCol = fk.RefColumns[0]
+			}
+			y1, y2 := from.rowY(fromCol), to.rowY(toCol)
+
+			var path string
+			switch {
+			case from == to:
+				// Self reference: loop out of the right edge and back in
+				r := from.x + from.w
+				path = fmt.Sprintf("M %.1f %.1f C %.1f %.1f, %.1f %.1f, %.1f %.1f", r, y1, r+40, y1, r+40, y2, r, y2)
+			case to.x+to.w <= from.x:
+				x1, x2 := from.x, to.x+to.w
+				mid := (x1 + x2) / 2
+				path = fmt.Sprintf("M %.1f %.1f C %.1f %.1f, %.1f %.1f, %.1f %.1f", x1, y1, mid, y1, mid, y2, x2, y2)
+			case from.x+from.w <= to.x:
+				x1, x2 := from.x+from.w, to.x
+				mid := (x1 + x2) / 2
+				path = fmt.Sprintf("M %.1f %.1f C %.1f %.1f, %.1f %.1f, %.1f %.1f", x1, y1, mid, y1, mid, y2, x2, y2)
+			default:
+				// Same column: route around the left side
+				l := math.Min(from.x, to.x)
+				path = fmt.Sprintf("M %.1f %.1f C %.1f %.1f, %.1f %.1f, %.1f %.1f", from.x, y1, l-40, y1, l-40, y2, to.x, y2)
+			}
+			fmt.Fprintf(&b, `<path d="%s" fill="none" stroke="#7f8c8d" stroke-width="1.5" marker-end="url(#arrow)"><title>%s</title></path>`+"\n",
+				path, html.EscapeString(fk.Name))
+		}
+	}
+
+	for i := range sc.Tables {
+		box := boxes[sc.Tables[i].qualifiedName()]
+		t := box.table
+		keys := t.columnKeys()
+
+		fmt.Fprintf(&b, `<g transform="translate(%.1f,%.1f)">`+"\n", box.x, box.y)
+		fmt.Fprintf(&b, `<rect width="%.1f" height="%.1f" rx="4" fill="white" stroke="#2c3e50"/>`+"\n", box.w, box.h)
+		fmt.Fprintf(&b, `<path d="M 0 %d V 4 Q 0 0 4 0 H %.1f Q %.1f 0 %.1f 4 V %d Z" fill="#3498db"/>`+"\n",
+			svgHeader, box.w-4, box.w, box.w, svgHeader)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" fill="white" font-weight="bold">%s</text>`+"\n",
+			svgPadding, svgHeader-8, html.EscapeString(t.qualifiedName()))
+
+		for j, col := range t.Columns {
+			y := svgHeader + j*svgRowHeight + svgRowHeight - 5
+			weight := "normal"
+			if k := keys[col.Name]; len(k) > 0 && k[0] == "PK" {
+				weight = "bold"
+			}
+			name := col.Name
+			if k := keys[col.Name]; len(k) > 0 {
+				name += " (" + strings.Join(k, ",") + ")"
+			}
+			fmt.Fprintf(&b, `<text x="%d" y="%d" font-weight="%s">%s</text>`, svgPadding, y, weight, html.EscapeString(name))
+			fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="end" fill="#7f8c8d">%s</text>`+"\n",
+				box.w-svgPadding, y, html.EscapeString(col.Type))
+		}
+		b.WriteString("</g>\n")
+	}
+
+	b.WriteString("</svg>\n")
+	return b.String()
+}
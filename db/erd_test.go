@@ -0,0 +1,109 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMermaidIdent(t *testing.T) {
+	tests := []struct {
+		in       string
+		fallback string
+		want     string
+	}{
+		{"employee", "table", "employee"},
+		{"hr.employee", "table", "hr_employee"},
+		{"a-b", "table", "a_b"},
+		{"__x__", "table", "x"},
+		{"character varying(20)", "type", "character_varying_20"},
+		{"2024_sales", "table", "table_2024_sales"},
+		{"é", "column", "column"},
+		{"", "type", "type"},
+	}
+
+	for _, tt := range tests {
+		if got := mermaidIdent(tt.in, tt.fallback); got != tt.want {
+			t.Errorf("mermaidIdent(%q, %q) = %q, want %q", tt.in, tt.fallback, got, tt.want)
+		}
+	}
+}
+
+func TestMermaid(t *testing.T) {
+	sc := &Schema{Tables: []Table{
+		{
+			Schema:     "public",
+			Name:       "a-b",
+			Columns:    []TableColumn{{Name: "id", Type: "integer"}},
+			PrimaryKey: []string{"id"},
+		},
+		{
+			Schema:     "public",
+			Name:       "a_b",
+			Columns:    []TableColumn{{Name: "id", Type: "integer"}},
+			PrimaryKey: []string{"id"},
+		},
+		{
+			Schema: "public",
+			Name:   "a_b_2",
+			Columns: []TableColumn{
+				{Name: `say "hi"`, Type: "text"},
+				{Name: "#ref", Type: "integer"},
+			},
+			ForeignKeys: []ForeignKey{
+				{Name: "fk1", Columns: []string{"#ref"}, RefSchema: "public", RefTable: "a-b"},
+				{Name: "fk2", Columns: []string{`say "hi"`, "é"}, RefSchema: "public", RefTable: "a_b"},
+			},
+		},
+	}}
+
+	want := "erDiagram\n" +
+		"    a_b {\n" +
+		"        integer id PK\n" +
+		"    }\n" +
+		"    a_b_2 {\n" +
+		"        integer id PK\n" +
+		"    }\n" +
+		"    a_b_2_2 {\n" +
+		"        text say_hi FK\n" +
+		"        integer ref FK\n" +
+		"    }\n" +
+		"    a_b ||--o{ a_b_2_2 : \"#35;ref\"\n" +
+		"    a_b_2 ||--o{ a_b_2_2 : \"say #quot;hi#quot;, é\"\n"
+	if got := sc.Mermaid(); got != want {
+		t.Errorf("Mermaid() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDOTQuoting(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"employee", `"employee"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{"café", `"café"`},
+		{"<b>", `"<b>"`},
+	}
+	for _, tt := range tests {
+		if got := dotQuote(tt.in); got != tt.want {
+			t.Errorf("dotQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	sc := &Schema{Tables: []Table{{
+		Schema:  "public",
+		Name:    `odd "table"`,
+		Columns: []TableColumn{{Name: "<col>", Type: "text"}},
+	}}}
+	dot := sc.DOT()
+	for _, want := range []string{
+		`    "odd \"table\"" [label=<`,
+		`<b>odd &#34;table&#34;</b>`,
+		`<td port="&lt;col&gt;" align="left">&lt;col&gt; : text</td>`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT() is missing %s:\n%s", want, dot)
+		}
+	}
+}
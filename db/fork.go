@@ -0,0 +1,324 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A fork freezes the state of a session's sandbox behind a token. Every
+// session created from the token starts with its own copy of that state.
+// The frozen database belongs to a role of its own, so it doesn't depend
+// on the source session, which may go away before the fork expires.
+
+var (
+	ErrForkNotFound = errors.New("fork not found or expired")
+	ErrForkQuota    = errors.New("fork quota reached")
+)
+
+// maxForksPerSession caps the live forks made from one session
+const maxForksPerSession = 5
+
+// forkTable holds the live forks of every instance
+const forkTable = "querylab_forks"
+
+// Fork is a frozen copy of a session's sandbox that new sessions start from
+type Fork struct {
+	Token     string    `json:"fork_token"`
+	DatasetID string    `json:"dataset"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// mu is held for writing while the fork is dropped, and for reading
+	// while a sandbox is cloned from it
+	mu            sync.RWMutex
+	dbName        string
+	sourceSession string
+}
+
+// CreateFork freezes the current state of a session's sandbox and returns
+// the fork with the token to share. Connections to the sandbox are closed
+// while it is copied.
+func (s *SandboxManager) CreateFork(sessionID string) (*Fork, error) {
+	entry, err := s.lockEntry(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer entry.ops.Unlock()
+	// Copying terminates the connections to the sandbox
+	defer s.markStickyDirty(sessionID)
+
+	s.forkMu.Lock()
+	count := 0
+	for _, f := range s.forks {
+		if f.sourceSession == sessionID {
+			count++
+		}
+	}
+	s.forkMu.Unlock()
+	if count >= maxForksPerSession {
+		return nil, fmt.Errorf("%w: at most %d per session", ErrForkQuota, maxForksPerSession)
+	}
+
+	token, err := newForkToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	f := &Fork{
+		Token:         token,
+		DatasetID:     entry.datasetID,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(s.config.ForkTTL),
+		dbName:        s.sandboxPrefix() + "fork_" + s.randomString(6),
+		sourceSession: sessionID,
+	}
+
+	if err := s.freezeFork(entry.dbName, f.dbName); err != nil {
+		slog.Error("failed to create fork", "sessionID", sessionID, "dbName", f.dbName, "error", err)
+		_ = s.dropSandboxDB(f.dbName)
+		return nil, err
+	}
+
+	s.forkMu.Lock()
+	s.forks[token] = f
+	s.forkMu.Unlock()
+	s.registerFork(f)
+
+	slog.Info("fork created", "sessionID", sessionID, "dbName", f.dbName, "expiresAt", f.ExpiresAt)
+	return f, nil
+}
+
+// freezeFork copies a sandbox into the database of a fork and hands the
+// objects of the sandbox role over to the fork's own role
+func (s *SandboxManager) freezeFork(srcDB, forkDB string) error {
+	db := s.base
+
+	if err := s.copyDatabase(db, srcDB, forkDB); err != nil {
+		return err
+	}
+	if err := s.markOwned(db, "DATABASE", forkDB); err != nil {
+		return err
+	}
+
+	// The fork role only owns objects, nobody logs in with it
+	if _, err := s.createSandboxRole(forkDB); err != nil {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf(`ALTER ROLE %s NOLOGIN`, sandboxRole(forkDB))); err != nil {
+		return err
+	}
+
+	if err := s.reassignSandboxObjects(forkDB, sandboxRole(srcDB), sandboxRole(forkDB)); err != nil {
+		return err
+	}
+	// DROP OWNED also revoked the source role's privileges on databases,
+	// among them CONNECT on its own sandbox
+	if err := s.grantSandboxPrivileges(srcDB); err != nil {
+		return err
+	}
+
+	// Like templates, forks are never connected to, cloning them needs that
+	s.evictConns(forkDB)
+	_, err := db.Exec(fmt.Sprintf(`ALTER DATABASE %s ALLOW_CONNECTIONS false`, forkDB))
+	return err
+}
+
+// CreateSessionFromFork provisions a new session with a copy of a fork.
+// It returns the new sandbox database name.
+func (s *SandboxManager) CreateSessionFromFork(sessionID, token string) (string, error) {
+	f, ok := s.lookupFork(token)
+	if !ok {
+		return "", ErrForkNotFound
+	}
+
+	s.mu.Lock()
+	if _, busy := s.inflight[sessionID]; busy {
+		s.mu.Unlock()
+		return "", fmt.Errorf("session %s is being provisioned", sessionID)
+	}
+	call := &provisionCall{done: make(chan struct{}), datasetID: f.DatasetID}
+	s.inflight[sessionID] = call
+	s.mu.Unlock()
+
+	return s.runProvision(sessionID, call, func() (*sandbox, error) {
+		return s.sandboxFromFork(f)
+	})
+}
+
+// sandboxFromFork creates a sandbox as a copy of a fork, with the objects
+// of the fork role handed over to the new sandbox role
+func (s *SandboxManager) sandboxFromFork(f *Fork) (*sandbox, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// The fork may have expired while waiting for the lock
+	if f.dbName == "" {
+		return nil, ErrForkNotFound
+	}
+
+	dbName := s.sandboxPrefix() + s.randomString(6)
+
+	_, err := s.base.Exec(fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s OWNER %s", dbName, f.dbName, s.config.AdminUser))
+	if err != nil {
+		slog.Error("failed to clone fork", "fork", f.dbName, "dbName", dbName, "error", err)
+		_ = s.dropDB(dbName)
+		return nil, err
+	}
+
+	if err := s.claimDatabase(dbName); err != nil {
+		slog.Error("failed to mark sandbox as owned", "dbName", dbName, "error", err)
+		_ = s.dropDB(dbName)
+		return nil, err
+	}
+
+	password, err := s.createSandboxRole(dbName)
+	if err != nil {
+		slog.Error("failed to create sandbox role", "dbName", dbName, "error", err)
+		_ = s.dropDB(dbName)
+		return nil, err
+	}
+
+	if err := s.reassignSandboxObjects(dbName, sandboxRole(f.dbName), sandboxRole(dbName)); err != nil {
+		slog.Error("failed to hand over forked objects", "dbName", dbName, "error", err)
+		_ = s.dropSandboxDB(dbName)
+		return nil, err
+	}
+
+	if err := s.grantSandboxPrivileges(dbName); err != nil {
+		slog.Error("failed to grant sandbox privileges", "dbName", dbName, "error", err)
+		_ = s.dropSandboxDB(dbName)
+		return nil, err
+	}
+
+	limits := s.config.Limits
+	if ds, err := s.datasets.Get(f.DatasetID); err == nil {
+		limits = s.limitsFor(ds)
+	}
+	if err := s.applyLimits(dbName, limits); err != nil {
+		slog.Error("failed to apply sandbox limits", "dbName", dbName, "error", err)
+		_ = s.dropSandboxDB(dbName)
+		return nil, err
+	}
+
+	return &sandbox{dbName: dbName, password: password}, nil
+}
+
+// lookupFork returns a live fork by token
+func (s *SandboxManager) lookupFork(token string) (*Fork, bool) {
+	s.forkMu.Lock()
+	defer s.forkMu.Unlock()
+
+	f, ok := s.forks[token]
+	if !ok || time.Now().After(f.ExpiresAt) {
+		return nil, false
+	}
+	return f, true
+}
+
+// dropExpiredForks drops the forks whose time is up
+func (s *SandboxManager) dropExpiredForks() {
+	now := time.Now()
+	var expired []*Fork
+
+	s.forkMu.Lock()
+	for token, f := range s.forks {
+		if now.After(f.ExpiresAt) {
+			expired = append(expired, f)
+			delete(s.forks, token)
+		}
+	}
+	s.forkMu.Unlock()
+
+	for _, f := range expired {
+		s.dropFork(f)
+	}
+	if len(expired) > 0 {
+		slog.Info("dropped expired forks", "count", len(expired))
+	}
+}
+
+// dropFork drops the database and role of a fork once no sandbox is being
+// cloned from it
+func (s *SandboxManager) dropFork(f *Fork) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := s.dropSandboxDB(f.dbName); err != nil {
+		slog.Warn("failed to drop fork", "dbName", f.dbName, "error", err)
+		return
+	}
+	s.unregisterFork(f.Token)
+	f.dbName = ""
+}
+
+// registerFork records a fork in the registry
+func (s *SandboxManager) registerFork(f *Fork) {
+	if s.registry == nil {
+		return
+	}
+	_, err := s.registry.Exec(fmt.Sprintf(`
+		INSERT INTO %s (token, instance_id, db_name, dataset_id, source_session, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, forkTable),
+		f.Token, s.config.InstanceID, f.dbName, f.DatasetID, f.sourceSession, f.CreatedAt, f.ExpiresAt)
+	if err != nil {
+		slog.Error("failed to register fork", "dbName", f.dbName, "error", err)
+	}
+}
+
+// unregisterFork removes a fork from the registry
+func (s *SandboxManager) unregisterFork(token string) {
+	if s.registry == nil {
+		return
+	}
+	if _, err := s.registry.Exec(fmt.Sprintf(`DELETE FROM %s WHERE token = $1`, forkTable), token); err != nil {
+		slog.Error("failed to unregister fork", "error", err)
+	}
+}
+
+// loadForks restores the forks of the registry. Forks whose database is
+// gone are forgotten; expired ones are dropped by the next cleanup.
+func (s *SandboxManager) loadForks() {
+	_, err := s.registry.Exec(fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE instance_id = $1
+		  AND NOT EXISTS (SELECT 1 FROM pg_database d WHERE d.datname = db_name)`, forkTable), s.config.InstanceID)
+	if err != nil {
+		slog.Error("failed to clean up fork registry", "error", err)
+		return
+	}
+
+	rows, err := s.registry.Query(fmt.Sprintf(`
+		SELECT token, db_name, dataset_id, source_session, created_at, expires_at
+		FROM %s WHERE instance_id = $1`, forkTable), s.config.InstanceID)
+	if err != nil {
+		slog.Error("failed to read fork registry", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	s.forkMu.Lock()
+	defer s.forkMu.Unlock()
+	for rows.Next() {
+		f := &Fork{}
+		if err := rows.Scan(&f.Token, &f.dbName, &f.DatasetID, &f.sourceSession, &f.CreatedAt, &f.ExpiresAt); err != nil {
+			slog.Error("failed to scan fork registry row", "error", err)
+			continue
+		}
+		s.forks[f.Token] = f
+	}
+	slog.Info("fork registry loaded", "forks", len(s.forks))
+}
+
+// newForkToken returns a random, unguessable fork token
+func newForkToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// testManager starts a manager against the PostgreSQL server named by the
+// TEST_DB_* variables, skipping the test without one. It runs as an
+// instance of its own and drops what it created when the test ends.
+func testManager(t *testing.T) *SandboxManager {
+	t.Helper()
+	user := os.Getenv("TEST_DB_ADMIN_USER")
+	if user == "" {
+		t.Skip("TEST_DB_ADMIN_USER is not set, no database to test against")
+	}
+	getenv := func(key, fallback string) string {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+		return fallback
+	}
+
+	s := NewSandboxManager(&DBConfig{
+		Host:          getenv("TEST_DB_HOST", "localhost"),
+		Port:          getenv("TEST_DB_PORT", "5432"),
+		AdminUser:     user,
+		AdminPassword: os.Getenv("TEST_DB_ADMIN_PASSWORD"),
+		InstanceID:    fmt.Sprintf("test%d", time.Now().UnixNano()%1e8),
+		BaseDB:        getenv("TEST_DB_NAME", "querylab"),
+		InitSQL:       "../init.sql",
+		MaxSnapshots:  3,
+	})
+	t.Cleanup(func() {
+		s.mu.RLock()
+		var sessions []string
+		for id := range s.sandboxes {
+			sessions = append(sessions, id)
+		}
+		s.mu.RUnlock()
+		for _, id := range sessions {
+			s.CleanupSession(id)
+		}
+
+		s.forkMu.Lock()
+		var forks []*Fork
+		for _, f := range s.forks {
+			forks = append(forks, f)
+		}
+		s.forkMu.Unlock()
+		for _, f := range forks {
+			s.dropFork(f)
+		}
+
+		templates, err := s.ownedDatabaseNames(s.base, s.instanceTemplatePrefix())
+		if err != nil {
+			t.Errorf("listing templates: %v", err)
+		}
+		for _, name := range templates {
+			s.dropTemplate(name)
+		}
+		s.Close()
+	})
+	return s
+}
+
+// querySession runs a query in a session's sandbox as its role
+func querySession(s *SandboxManager, sessionID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := s.Conn(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, "CREATE TEMP TABLE t AS SELECT 1 AS n")
+	return err
+}
+
+func TestForkKeepsSourceSession(t *testing.T) {
+	s := testManager(t)
+
+	source := s.GenerateSessionID()
+	if _, err := s.GetOrCreateSession(source, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := querySession(s, source); err != nil {
+		t.Fatalf("querying the source session before the fork: %v", err)
+	}
+
+	f, err := s.CreateFork(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Forking hands the source role's objects in the copy over to the
+	// fork role, which must leave the source sandbox as it was
+	if err := querySession(s, source); err != nil {
+		t.Errorf("querying the source session after the fork: %v", err)
+	}
+
+	forked := s.GenerateSessionID()
+	if _, err := s.CreateSessionFromFork(forked, f.Token); err != nil {
+		t.Fatal(err)
+	}
+	if err := querySession(s, forked); err != nil {
+		t.Errorf("querying a session of the fork: %v", err)
+	}
+	if err := querySession(s, source); err != nil {
+		t.Errorf("querying the source session after cloning the fork: %v", err)
+	}
+}
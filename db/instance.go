@@ -0,0 +1,86 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Several QueryLab instances can share one PostgreSQL cluster. Every
+// instance names its databases and roles with its instance ID and records
+// itself as their owner in a comment, and only ever cleans up its own.
+
+// DefaultInstanceID is used when no instance ID is configured
+const DefaultInstanceID = "default"
+
+// validInstanceID keeps instance IDs usable inside unquoted identifiers
+var validInstanceID = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+
+// checkInstanceID validates the configured instance ID, falling back to
+// the default one
+func checkInstanceID(id string) string {
+	if id == "" {
+		return DefaultInstanceID
+	}
+	if !validInstanceID.MatchString(id) {
+		slog.Error("invalid instance ID, must be 1-16 lowercase letters or digits; using the default",
+			"instanceID", id,
+			"default", DefaultInstanceID,
+		)
+		return DefaultInstanceID
+	}
+	return id
+}
+
+// sandboxPrefix is the name prefix of this instance's sandbox databases
+func (s *SandboxManager) sandboxPrefix() string {
+	return "sandbox_" + s.config.InstanceID + "_"
+}
+
+// instanceTemplatePrefix is the name prefix of this instance's templates
+func (s *SandboxManager) instanceTemplatePrefix() string {
+	return templatePrefix + s.config.InstanceID + "_"
+}
+
+// ownerComment marks a database or role as belonging to this instance
+func (s *SandboxManager) ownerComment() string {
+	return "querylab:instance=" + s.config.InstanceID
+}
+
+// markOwned records this instance as the owner of a database or role;
+// kind is DATABASE or ROLE
+func (s *SandboxManager) markOwned(db *sql.DB, kind, name string) error {
+	_, err := db.Exec(fmt.Sprintf(`COMMENT ON %s %s IS %s`, kind, name, pq.QuoteLiteral(s.ownerComment())))
+	return err
+}
+
+// claimDatabase marks a database as belonging to this instance
+func (s *SandboxManager) claimDatabase(dbName string) error {
+	return s.markOwned(s.base, "DATABASE", dbName)
+}
+
+// likePrefix returns a LIKE pattern matching names starting with prefix
+func likePrefix(prefix string) string {
+	return strings.ReplaceAll(prefix, "_", `\_`) + "%"
+}
+
+// ownedDatabaseNames lists the databases with the given name prefix that
+// this instance owns
+func (s *SandboxManager) ownedDatabaseNames(db *sql.DB, prefix string) ([]string, error) {
+	return queryNames(db, `
+		SELECT datname FROM pg_database
+		WHERE datname LIKE $1 AND shobj_description(oid, 'pg_database') = $2`,
+		likePrefix(prefix), s.ownerComment())
+}
+
+// ownedSandboxRoles lists the sandbox roles this instance owns
+func (s *SandboxManager) ownedSandboxRoles(db *sql.DB) ([]string, error) {
+	return queryNames(db, `
+		SELECT rolname FROM pg_roles
+		WHERE rolname LIKE $1 AND shobj_description(oid, 'pg_authid') = $2`,
+		likePrefix(s.sandboxPrefix()), s.ownerComment())
+}
@@ -0,0 +1,65 @@
+package db
+
+import "testing"
+
+func TestCheckInstanceID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"", DefaultInstanceID},
+		{"staging", "staging"},
+		{"ci42", "ci42"},
+		{"abcdefghijklmnop", "abcdefghijklmnop"},
+		{"abcdefghijklmnopq", DefaultInstanceID}, // too long
+		{"Staging", DefaultInstanceID},
+		{"a_b", DefaultInstanceID},
+		{"a-b", DefaultInstanceID},
+		{"a;drop", DefaultInstanceID},
+	}
+	for _, tt := range tests {
+		if got := checkInstanceID(tt.id); got != tt.want {
+			t.Errorf("checkInstanceID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestInstanceNames(t *testing.T) {
+	tests := []struct {
+		id             string
+		sandboxPrefix  string
+		templatePrefix string
+		comment        string
+	}{
+		{DefaultInstanceID, "sandbox_default_", templatePrefix + "default_", "querylab:instance=default"},
+		{"ci42", "sandbox_ci42_", templatePrefix + "ci42_", "querylab:instance=ci42"},
+	}
+	for _, tt := range tests {
+		s := &SandboxManager{config: &DBConfig{InstanceID: tt.id}}
+		if got := s.sandboxPrefix(); got != tt.sandboxPrefix {
+			t.Errorf("%s: sandboxPrefix() = %q, want %q", tt.id, got, tt.sandboxPrefix)
+		}
+		if got := s.instanceTemplatePrefix(); got != tt.templatePrefix {
+			t.Errorf("%s: instanceTemplatePrefix() = %q, want %q", tt.id, got, tt.templatePrefix)
+		}
+		if got := s.ownerComment(); got != tt.comment {
+			t.Errorf("%s: ownerComment() = %q, want %q", tt.id, got, tt.comment)
+		}
+	}
+}
+
+func TestLikePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"sandbox_default_", `sandbox\_default\_%`},
+		{"querylab", "querylab%"},
+		{"", "%"},
+	}
+	for _, tt := range tests {
+		if got := likePrefix(tt.prefix); got != tt.want {
+			t.Errorf("likePrefix(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
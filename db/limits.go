@@ -0,0 +1,99 @@
+package db
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/lib/pq"
+)
+
+// Limits are the resource limits of a sandbox database. Values use
+// PostgreSQL syntax, e.g. "3s" or "16MB"; an empty value keeps the server
+// default. They are set on the database with ALTER DATABASE ... SET, so
+// every connection to the sandbox picks them up.
+type Limits struct {
+	StatementTimeout         string // statement_timeout
+	LockTimeout              string // lock_timeout
+	IdleInTransactionTimeout string // idle_in_transaction_session_timeout
+	WorkMem                  string // work_mem
+	TempFileLimit            string // temp_file_limit, needs the SET privilege on it
+}
+
+// Merge returns l with the non-empty values of override applied
+func (l Limits) Merge(override Limits) Limits {
+	pick := func(base, over string) string {
+		if over != "" {
+			return over
+		}
+		return base
+	}
+	return Limits{
+		StatementTimeout:         pick(l.StatementTimeout, override.StatementTimeout),
+		LockTimeout:              pick(l.LockTimeout, override.LockTimeout),
+		IdleInTransactionTimeout: pick(l.IdleInTransactionTimeout, override.IdleInTransactionTimeout),
+		WorkMem:                  pick(l.WorkMem, override.WorkMem),
+		TempFileLimit:            pick(l.TempFileLimit, override.TempFileLimit),
+	}
+}
+
+// settings returns the configuration parameters of l that have a value
+func (l Limits) settings() [][2]string {
+	var out [][2]string
+	for _, s := range [][2]string{
+		{"statement_timeout", l.StatementTimeout},
+		{"lock_timeout", l.LockTimeout},
+		{"idle_in_transaction_session_timeout", l.IdleInTransactionTimeout},
+		{"work_mem", l.WorkMem},
+		{"temp_file_limit", l.TempFileLimit},
+	} {
+		if s[1] != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// set assigns a limit by its parameter name, for dataset headers
+func (l *Limits) set(name, value string) bool {
+	switch name {
+	case "statement_timeout":
+		l.StatementTimeout = value
+	case "lock_timeout":
+		l.LockTimeout = value
+	case "idle_in_transaction_session_timeout":
+		l.IdleInTransactionTimeout = value
+	case "work_mem":
+		l.WorkMem = value
+	case "temp_file_limit":
+		l.TempFileLimit = value
+	default:
+		return false
+	}
+	return true
+}
+
+// limitsFor returns the limits of a dataset: the configured defaults with
+// the dataset's own overrides
+func (s *SandboxManager) limitsFor(ds *Dataset) Limits {
+	return s.config.Limits.Merge(ds.Limits)
+}
+
+// applyLimits sets the limits on a sandbox database. temp_file_limit can
+// only be set by superusers or roles granted SET on it, so failing to set
+// it is not fatal.
+func (s *SandboxManager) applyLimits(dbName string, limits Limits) error {
+	db := s.base
+
+	for _, setting := range limits.settings() {
+		stmt := fmt.Sprintf(`ALTER DATABASE %s SET %s = %s`, dbName, setting[0], pq.QuoteLiteral(setting[1]))
+		if _, err := db.Exec(stmt); err != nil {
+			if setting[0] == "temp_file_limit" {
+				slog.Warn("failed to set temp_file_limit", "dbName", dbName, "error", err)
+				continue
+			}
+			slog.Error("failed to apply limit", "statement", stmt, "error", err)
+			return err
+		}
+	}
+	return nil
+}
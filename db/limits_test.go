@@ -0,0 +1,99 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLimitsMerge(t *testing.T) {
+	base := Limits{StatementTimeout: "3s", LockTimeout: "2s", WorkMem: "16MB"}
+
+	tests := []struct {
+		name     string
+		override Limits
+		want     Limits
+	}{
+		{"no overrides", Limits{}, base},
+		{
+			"overrides replace",
+			Limits{StatementTimeout: "10s", WorkMem: "64MB"},
+			Limits{StatementTimeout: "10s", LockTimeout: "2s", WorkMem: "64MB"},
+		},
+		{
+			"overrides add",
+			Limits{TempFileLimit: "1GB", IdleInTransactionTimeout: "30s"},
+			Limits{StatementTimeout: "3s", LockTimeout: "2s", IdleInTransactionTimeout: "30s", WorkMem: "16MB", TempFileLimit: "1GB"},
+		},
+	}
+	for _, tt := range tests {
+		if got := base.Merge(tt.override); got != tt.want {
+			t.Errorf("%s: Merge(%+v) = %+v, want %+v", tt.name, tt.override, got, tt.want)
+		}
+	}
+}
+
+func TestLimitsSettings(t *testing.T) {
+	tests := []struct {
+		limits Limits
+		want   [][2]string
+	}{
+		{Limits{}, nil},
+		{
+			Limits{WorkMem: "16MB", StatementTimeout: "3s"},
+			[][2]string{{"statement_timeout", "3s"}, {"work_mem", "16MB"}},
+		},
+		{
+			Limits{StatementTimeout: "3s", LockTimeout: "2s", IdleInTransactionTimeout: "60s", WorkMem: "16MB", TempFileLimit: "1GB"},
+			[][2]string{
+				{"statement_timeout", "3s"},
+				{"lock_timeout", "2s"},
+				{"idle_in_transaction_session_timeout", "60s"},
+				{"work_mem", "16MB"},
+				{"temp_file_limit", "1GB"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.limits.settings(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("settings() of %+v = %v, want %v", tt.limits, got, tt.want)
+		}
+	}
+}
+
+func TestLimitsSet(t *testing.T) {
+	var l Limits
+	for _, s := range (Limits{StatementTimeout: "1s", LockTimeout: "2s", IdleInTransactionTimeout: "3s", WorkMem: "4MB", TempFileLimit: "5MB"}).settings() {
+		if !l.set(s[0], s[1]) {
+			t.Errorf("set(%q) = false for a known limit", s[0])
+		}
+	}
+	if want := (Limits{StatementTimeout: "1s", LockTimeout: "2s", IdleInTransactionTimeout: "3s", WorkMem: "4MB", TempFileLimit: "5MB"}); l != want {
+		t.Errorf("after set, limits = %+v, want %+v", l, want)
+	}
+
+	if l.set("search_path", "public") {
+		t.Error("set accepted a parameter that is not a limit")
+	}
+}
+
+func TestLoadDatasetLimits(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "ds.sql",
+		"-- name: Heavy\n"+
+			"-- Statement_Timeout: 10s\n"+
+			"-- work_mem: 64MB\n"+
+			"-- search_path: not a limit\n"+
+			"CREATE TABLE t (id int);\n")
+
+	ds, err := loadDataset("ds", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Limits{StatementTimeout: "10s", WorkMem: "64MB"}); ds.Limits != want {
+		t.Errorf("Limits = %+v, want %+v", ds.Limits, want)
+	}
+
+	s := &SandboxManager{config: &DBConfig{Limits: Limits{StatementTimeout: "3s", LockTimeout: "2s"}}}
+	if got, want := s.limitsFor(ds), (Limits{StatementTimeout: "10s", LockTimeout: "2s", WorkMem: "64MB"}); got != want {
+		t.Errorf("limitsFor() = %+v, want %+v", got, want)
+	}
+}
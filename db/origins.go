@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// The RowDescription message describing the columns of a result names the
+// table and column each one comes from, but lib/pq drops both. Sandbox
+// connections are unencrypted, so a wrapper around the network connection
+// reads them off the wire on their way to lib/pq.
+
+// ColumnOrigin is the table column a result column comes from. Both are
+// zero for computed columns.
+type ColumnOrigin struct {
+	Table  uint32 // pg_class OID of the table
+	Column int16  // attribute number of the column
+}
+
+// originKey carries the originConn a connection should be wrapped in
+// from cappedConnector.Connect to the dialer
+type originKey struct{}
+
+// originDialer dials sandbox connections, wrapping them in the originConn
+// found in the context
+type originDialer struct {
+	net.Dialer
+}
+
+func (d *originDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d *originDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if oc, ok := ctx.Value(originKey{}).(*originConn); ok {
+		oc.Conn = conn
+		return oc, nil
+	}
+	return conn, nil
+}
+
+// originConn follows the messages the server sends and keeps the column
+// origins of the last RowDescription
+type originConn struct {
+	net.Conn
+
+	header [5]byte // message type and length
+	got    int     // header bytes read so far
+	left   int     // body bytes still to come
+	body   []byte  // body of the RowDescription being read
+
+	mu      sync.Mutex
+	origins []ColumnOrigin
+}
+
+func (c *originConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.scan(p[:n])
+	return n, err
+}
+
+// scan follows the message framing: a type byte and a length that counts
+// itself, then the body
+func (c *originConn) scan(p []byte) {
+	for {
+		if c.got < len(c.header) {
+			if len(p) == 0 {
+				return
+			}
+			k := copy(c.header[c.got:], p)
+			c.got += k
+			p = p[k:]
+			if c.got < len(c.header) {
+				return
+			}
+			c.left = max(int(binary.BigEndian.Uint32(c.header[1:]))-4, 0)
+			c.body = c.body[:0]
+		}
+
+		k := min(c.left, len(p))
+		if c.header[0] == 'T' {
+			c.body = append(c.body, p[:k]...)
+		}
+		c.left -= k
+		p = p[k:]
+		if c.left > 0 {
+			return
+		}
+
+		switch c.header[0] {
+		case 'T':
+			c.setOrigins(parseRowDescription(c.body))
+		case 'n':
+			// NoData, the statement described returns no rows
+			c.setOrigins(nil)
+		}
+		c.got = 0
+	}
+}
+
+func (c *originConn) setOrigins(origins []ColumnOrigin) {
+	c.mu.Lock()
+	c.origins = origins
+	c.mu.Unlock()
+}
+
+// rowOrigins returns the column origins of the last RowDescription
+func (c *originConn) rowOrigins() []ColumnOrigin {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.origins
+}
+
+// parseRowDescription reads the column origins from the body of a
+// RowDescription: the column count, then per column its name, table OID,
+// attribute number, type OID, type length, type modifier and format
+func parseRowDescription(b []byte) []ColumnOrigin {
+	if len(b) < 2 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+
+	origins := make([]ColumnOrigin, 0, n)
+	for range n {
+		end := bytes.IndexByte(b, 0)
+		if end < 0 || len(b) < end+1+18 {
+			return nil
+		}
+		b = b[end+1:]
+		origins = append(origins, ColumnOrigin{
+			Table:  binary.BigEndian.Uint32(b),
+			Column: int16(binary.BigEndian.Uint16(b[4:])),
+		})
+		b = b[18:]
+	}
+	return origins
+}
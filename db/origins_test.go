@@ -0,0 +1,84 @@
+package db
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// message builds a backend message of the given type
+func message(typ byte, body []byte) []byte {
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+// rowDescription builds the body of a RowDescription for int4 columns
+func rowDescription(names []string, origins []ColumnOrigin) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(names)))
+	for i, name := range names {
+		b = append(b, name...)
+		b = append(b, 0)
+		b = binary.BigEndian.AppendUint32(b, origins[i].Table)
+		b = binary.BigEndian.AppendUint16(b, uint16(origins[i].Column))
+		b = binary.BigEndian.AppendUint32(b, 23) // int4
+		b = binary.BigEndian.AppendUint16(b, 4)
+		b = binary.BigEndian.AppendUint32(b, 0xffffffff)
+		b = binary.BigEndian.AppendUint16(b, 0)
+	}
+	return b
+}
+
+func TestParseRowDescription(t *testing.T) {
+	origins := []ColumnOrigin{{Table: 16384, Column: 1}, {}, {Table: 16390, Column: -1}}
+	body := rowDescription([]string{"id", "?column?", "ctid"}, origins)
+
+	tests := []struct {
+		name string
+		body []byte
+		want []ColumnOrigin
+	}{
+		{"columns", body, origins},
+		{"no columns", []byte{0, 0}, []ColumnOrigin{}},
+		{"truncated", body[:len(body)-1], nil},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		if got := parseRowDescription(tt.body); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseRowDescription() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOriginConnScan(t *testing.T) {
+	origins := []ColumnOrigin{{Table: 16384, Column: 2}}
+	desc := message('T', rowDescription([]string{"name"}, origins))
+
+	var stream []byte
+	stream = append(stream, message('1', nil)...)                           // ParseComplete
+	stream = append(stream, message('t', []byte{0, 0})...)                  // ParameterDescription
+	stream = append(stream, desc...)                                        // RowDescription
+	stream = append(stream, message('Z', []byte{'I'})...)                   // ReadyForQuery
+	stream = append(stream, message('D', []byte{0, 1, 0, 0, 0, 1, 'x'})...) // DataRow
+
+	// Messages split across reads at different points
+	for _, size := range []int{1, 2, 3, 5, 7, len(stream)} {
+		c := &originConn{}
+		for p := stream; len(p) > 0; {
+			n := min(size, len(p))
+			c.scan(p[:n])
+			p = p[n:]
+		}
+		if got := c.rowOrigins(); !reflect.DeepEqual(got, origins) {
+			t.Errorf("reads of %d bytes: rowOrigins() = %v, want %v", size, got, origins)
+		}
+	}
+
+	// NoData clears the origins of an earlier statement
+	c := &originConn{}
+	c.scan(desc)
+	c.scan(message('n', nil))
+	if got := c.rowOrigins(); got != nil {
+		t.Errorf("after NoData rowOrigins() = %v, want none", got)
+	}
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// warmPool keeps a number of fully provisioned sandboxes of the default
+// dataset ready so new sessions don't have to wait for database creation
+type warmPool struct {
+	ready  chan *sandbox
+	refill chan struct{}
+	stop   chan struct{} // closed on shutdown
+	done   chan struct{} // closed when the refill loop has returned
+
+	mu      sync.Mutex
+	members map[string]bool // databases of the ready sandboxes
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// PoolStats reports the state of the warm sandbox pool
+type PoolStats struct {
+	Size   int   `json:"size"`
+	Ready  int   `json:"ready"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+func newWarmPool(size int) *warmPool {
+	return &warmPool{
+		ready:  make(chan *sandbox, size),
+		refill: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+
+		members: make(map[string]bool),
+	}
+}
+
+// put adds a ready sandbox to the pool
+func (p *warmPool) put(sb *sandbox) {
+	p.mu.Lock()
+	p.members[sb.dbName] = true
+	p.mu.Unlock()
+	p.ready <- sb
+}
+
+// take removes a ready sandbox from the pool without blocking
+func (p *warmPool) take() (*sandbox, bool) {
+	select {
+	case sb := <-p.ready:
+		p.mu.Lock()
+		delete(p.members, sb.dbName)
+		p.mu.Unlock()
+		return sb, true
+	default:
+		return nil, false
+	}
+}
+
+// owns reports whether a database belongs to a ready sandbox
+func (p *warmPool) owns(dbName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.members[dbName]
+}
+
+// requestRefill wakes up the refill loop without blocking
+func (p *warmPool) requestRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// runPool keeps the pool filled up, retrying with a backoff on failures
+func (s *SandboxManager) runPool() {
+	defer close(s.pool.done)
+
+	ds, _ := s.datasets.Get(DefaultDatasetID)
+	backoff := time.Second
+
+	for {
+		for len(s.pool.ready) < cap(s.pool.ready) {
+			select {
+			case <-s.pool.stop:
+				return
+			default:
+			}
+
+			sb, err := s.newSandbox(ds)
+			if err != nil {
+				slog.Error("failed to provision pooled sandbox", "error", err, "retryIn", backoff)
+				select {
+				case <-time.After(backoff):
+				case <-s.pool.stop:
+					return
+				}
+				backoff = min(backoff*2, time.Minute)
+				continue
+			}
+			backoff = time.Second
+
+			s.pool.put(sb)
+			slog.Info("pooled sandbox ready", "dbName", sb.dbName, "ready", len(s.pool.ready))
+		}
+
+		select {
+		case <-s.pool.refill:
+		case <-s.pool.stop:
+			return
+		}
+	}
+}
+
+// drainPool stops refilling the pool and drops the ready sandboxes. It
+// waits for a sandbox being provisioned, which would leak otherwise.
+func (s *SandboxManager) drainPool() {
+	close(s.pool.stop)
+	<-s.pool.done
+	for {
+		sb, ok := s.pool.take()
+		if !ok {
+			return
+		}
+		_ = s.dropSandboxDB(sb.dbName)
+	}
+}
+
+// takePooled hands out a ready sandbox, or returns false when the pool is
+// empty or disabled. Sandboxes cloned from an outdated template are dropped.
+func (s *SandboxManager) takePooled() (*sandbox, bool) {
+	if s.pool == nil {
+		return nil, false
+	}
+	defer s.pool.requestRefill()
+
+	ds, _ := s.datasets.Get(DefaultDatasetID)
+	current := s.currentTemplate(ds)
+	for {
+		sb, ok := s.pool.take()
+		if !ok {
+			misses := s.pool.misses.Add(1)
+			slog.Warn("sandbox pool empty, provisioning synchronously",
+				"hits", s.pool.hits.Load(),
+				"misses", misses,
+			)
+			return nil, false
+		}
+		if sb.template != current {
+			slog.Info("discarding pooled sandbox from outdated template", "dbName", sb.dbName)
+			go s.dropSandboxDB(sb.dbName)
+			continue
+		}
+		s.pool.hits.Add(1)
+		return sb, true
+	}
+}
+
+// PoolStats returns hit/miss counters and the number of ready sandboxes
+func (s *SandboxManager) PoolStats() PoolStats {
+	if s.pool == nil {
+		return PoolStats{}
+	}
+	return PoolStats{
+		Size:   cap(s.pool.ready),
+		Ready:  len(s.pool.ready),
+		Hits:   s.pool.hits.Load(),
+		Misses: s.pool.misses.Load(),
+	}
+}
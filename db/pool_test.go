@@ -0,0 +1,78 @@
+package db
+
+import "testing"
+
+func TestWarmPoolTakeAndOwns(t *testing.T) {
+	p := newWarmPool(2)
+
+	if _, ok := p.take(); ok {
+		t.Fatal("take on an empty pool returned a sandbox")
+	}
+
+	p.put(&sandbox{dbName: "a"})
+	p.put(&sandbox{dbName: "b"})
+	for _, name := range []string{"a", "b"} {
+		if !p.owns(name) {
+			t.Errorf("owns(%q) = false for a ready sandbox", name)
+		}
+	}
+
+	tests := []struct {
+		want   string
+		owned  []string
+		others []string
+	}{
+		{"a", []string{"b"}, []string{"a"}},
+		{"b", nil, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		sb, ok := p.take()
+		if !ok || sb.dbName != tt.want {
+			t.Fatalf("take() = %v, %v, want %q", sb, ok, tt.want)
+		}
+		for _, name := range tt.owned {
+			if !p.owns(name) {
+				t.Errorf("after taking %q, owns(%q) = false", tt.want, name)
+			}
+		}
+		for _, name := range tt.others {
+			if p.owns(name) {
+				t.Errorf("after taking %q, owns(%q) = true", tt.want, name)
+			}
+		}
+	}
+
+	if _, ok := p.take(); ok {
+		t.Error("take on a drained pool returned a sandbox")
+	}
+}
+
+func TestWarmPoolRequestRefill(t *testing.T) {
+	p := newWarmPool(1)
+
+	// Requests coalesce into one wakeup and never block
+	for range 3 {
+		p.requestRefill()
+	}
+	select {
+	case <-p.refill:
+	default:
+		t.Fatal("requestRefill did not wake up the refill loop")
+	}
+	select {
+	case <-p.refill:
+		t.Fatal("requestRefill queued more than one wakeup")
+	default:
+	}
+}
+
+func TestPoolDisabled(t *testing.T) {
+	s := &SandboxManager{}
+
+	if sb, ok := s.takePooled(); ok {
+		t.Errorf("takePooled without a pool = %v, true", sb)
+	}
+	if stats := s.PoolStats(); stats != (PoolStats{}) {
+		t.Errorf("PoolStats without a pool = %+v", stats)
+	}
+}
@@ -0,0 +1,264 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The reconciler finds sandbox databases and roles of this instance that no
+// session owns, e.g. because a drop failed or the server crashed, and drops
+// them once they stayed unowned for a grace period. Failed drops are
+// retried with a backoff.
+
+// reconcileMaxBackoff caps the delay between retries of a failing drop
+const reconcileMaxBackoff = time.Hour
+
+// ReconcileStats reports what the orphan reconciler found and did
+type ReconcileStats struct {
+	Runs     int64     `json:"runs"`
+	LastRun  time.Time `json:"last_run"`
+	Orphans  int       `json:"orphans"` // unowned databases and roles found by the last run
+	Leaked   int       `json:"leaked"`  // orphans whose drop failed, waiting for a retry
+	Dropped  int64     `json:"dropped"`
+	Failures int64     `json:"failures"`
+}
+
+// orphan is an unowned sandbox database or role
+type orphan struct {
+	firstSeen time.Time
+	attempts  int // failed drops
+	retryAt   time.Time
+}
+
+type reconciler struct {
+	mu      sync.Mutex
+	orphans map[string]*orphan // keyed by "db:<name>" or "role:<name>"
+	stats   ReconcileStats
+}
+
+func newReconciler() *reconciler {
+	return &reconciler{orphans: make(map[string]*orphan)}
+}
+
+// runReconciler reconciles periodically
+func (s *SandboxManager) runReconciler() {
+	ticker := time.NewTicker(s.config.ReconcileInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.reconcile(s.config.OrphanGracePeriod)
+	}
+}
+
+// reconcile drops the sandbox databases and roles that have been unowned
+// for longer than grace. A zero grace drops them right away, which is only
+// safe before the manager starts provisioning.
+func (s *SandboxManager) reconcile(grace time.Duration) {
+	db := s.base
+
+	owned, err := s.ownedDatabases(db)
+	if err != nil {
+		slog.Error("reconcile: failed to read owned databases", "error", err)
+		return
+	}
+	dbs, err := s.ownedDatabaseNames(db, s.sandboxPrefix())
+	if err != nil {
+		slog.Error("reconcile: failed to list sandbox databases", "error", err)
+		return
+	}
+	roles, err := s.ownedSandboxRoles(db)
+	if err != nil {
+		slog.Error("reconcile: failed to list sandbox roles", "error", err)
+		return
+	}
+
+	candidates := findOrphans(owned, dbs, roles)
+	now := time.Now()
+	due, leaked := s.reconciler.dueOrphans(candidates, grace, now)
+
+	// Drop outside the lock, so ReconcileStats doesn't wait for slow drops
+	failed := make(map[string]error)
+	for _, key := range due {
+		drop := s.dropSandboxRole
+		if strings.HasPrefix(key, "db:") {
+			drop = s.dropSandboxDB
+		}
+		if err := drop(candidates[key]); err != nil {
+			failed[key] = err
+		}
+	}
+
+	s.reconciler.recordDrops(due, failed, len(candidates), leaked, now)
+}
+
+// findOrphans returns the unowned sandbox databases and roles, keyed by
+// "db:<database>" or "role:<role>", with the name of their database
+func findOrphans(owned map[string]bool, dbs, roles []string) map[string]string {
+	// Dropping a database drops its role too. Roles are only orphans on
+	// their own when their database is already gone.
+	exists := make(map[string]bool, len(dbs))
+	candidates := make(map[string]string)
+	for _, name := range dbs {
+		exists[name] = true
+		if !owned[name] {
+			candidates["db:"+name] = name
+		}
+	}
+	for _, role := range roles {
+		name := strings.TrimSuffix(role, "_user")
+		if !owned[name] && !exists[name] {
+			candidates["role:"+role] = name
+		}
+	}
+	return candidates
+}
+
+// dueOrphans tracks the orphans a run found and returns those due for a
+// drop: unowned for longer than grace and not waiting for a retry. leaked
+// counts the others whose drop failed before.
+func (r *reconciler) dueOrphans(candidates map[string]string, grace time.Duration, now time.Time) (due []string, leaked int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key := range r.orphans {
+		if _, ok := candidates[key]; !ok {
+			// Owned again, e.g. a sandbox that was still being provisioned, or gone
+			delete(r.orphans, key)
+		}
+	}
+
+	for key := range candidates {
+		o, ok := r.orphans[key]
+		if !ok {
+			o = &orphan{firstSeen: now}
+			r.orphans[key] = o
+		}
+		if now.Sub(o.firstSeen) < grace || now.Before(o.retryAt) {
+			if o.attempts > 0 {
+				leaked++
+			}
+			continue
+		}
+		due = append(due, key)
+		slog.Info("reconcile: dropping orphan", "orphan", key, "unownedFor", now.Sub(o.firstSeen), "attempt", o.attempts+1)
+	}
+	return due, leaked
+}
+
+// recordDrops records the outcome of the drops of a run. Failed drops are
+// retried with a backoff.
+func (r *reconciler) recordDrops(due []string, failed map[string]error, orphans, leaked int, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range due {
+		o := r.orphans[key]
+		err, ok := failed[key]
+		if !ok {
+			delete(r.orphans, key)
+			r.stats.Dropped++
+			continue
+		}
+		o.attempts++
+		o.retryAt = now.Add(min(time.Minute<<min(o.attempts, 10), reconcileMaxBackoff))
+		r.stats.Failures++
+		leaked++
+		slog.Warn("reconcile: failed to drop orphan", "orphan", key, "attempts", o.attempts, "retryAt", o.retryAt, "error", err)
+	}
+
+	r.stats.Runs++
+	r.stats.LastRun = now
+	r.stats.Orphans = orphans
+	r.stats.Leaked = leaked
+	if orphans > 0 {
+		slog.Info("reconcile finished", "orphans", orphans, "leaked", leaked, "dropped", r.stats.Dropped)
+	}
+}
+
+// ownedDatabases returns the sandbox databases, snapshots and forks that
+// belong to a session, the warm pool or the registry
+func (s *SandboxManager) ownedDatabases(db *sql.DB) (map[string]bool, error) {
+	owned := make(map[string]bool)
+
+	if s.registry != nil {
+		names, err := queryNames(db, fmt.Sprintf(`SELECT db_name FROM %s WHERE instance_id = $1`, registryTable), s.config.InstanceID)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			owned[name] = true
+		}
+
+		names, err = queryNames(db, fmt.Sprintf(`
+			SELECT sn.db_name FROM %s sn
+			JOIN %s r ON r.session_id = sn.session_id
+			WHERE r.instance_id = $1`, snapshotTable, registryTable), s.config.InstanceID)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			owned[name] = true
+		}
+
+		names, err = queryNames(db, fmt.Sprintf(`SELECT db_name FROM %s WHERE instance_id = $1`, forkTable), s.config.InstanceID)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			owned[name] = true
+		}
+	}
+
+	s.forkMu.Lock()
+	for _, f := range s.forks {
+		owned[f.dbName] = true
+	}
+	s.forkMu.Unlock()
+
+	s.mu.RLock()
+	for _, entry := range s.sandboxes {
+		owned[entry.dbName] = true
+		for _, snap := range entry.snapshots {
+			owned[snap.dbName] = true
+		}
+	}
+	s.mu.RUnlock()
+
+	if s.pool != nil {
+		s.pool.mu.Lock()
+		for name := range s.pool.members {
+			owned[name] = true
+		}
+		s.pool.mu.Unlock()
+	}
+	return owned, nil
+}
+
+// ReconcileStats returns the counters of the orphan reconciler
+func (s *SandboxManager) ReconcileStats() ReconcileStats {
+	s.reconciler.mu.Lock()
+	defer s.reconciler.mu.Unlock()
+	return s.reconciler.stats
+}
+
+func queryNames(db *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
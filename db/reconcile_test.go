@@ -0,0 +1,102 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFindOrphans(t *testing.T) {
+	owned := map[string]bool{"sandbox_default_aaaaaa": true, "sandbox_default_bbbbbb": true}
+	dbs := []string{"sandbox_default_aaaaaa", "sandbox_default_cccccc"}
+	roles := []string{
+		"sandbox_default_aaaaaa_user", // owned
+		"sandbox_default_bbbbbb_user", // owned, database still being created
+		"sandbox_default_cccccc_user", // dropped with its database
+		"sandbox_default_dddddd_user", // database gone
+	}
+
+	want := map[string]string{
+		"db:sandbox_default_cccccc":        "sandbox_default_cccccc",
+		"role:sandbox_default_dddddd_user": "sandbox_default_dddddd",
+	}
+	if got := findOrphans(owned, dbs, roles); !reflect.DeepEqual(got, want) {
+		t.Errorf("findOrphans() = %v, want %v", got, want)
+	}
+}
+
+func TestReconcilerGraceAndBackoff(t *testing.T) {
+	r := newReconciler()
+	grace := 10 * time.Minute
+	start := time.Now()
+	orphans := map[string]string{"db:a": "a", "db:b": "b"}
+	errDrop := errors.New("database is being accessed by other users")
+
+	tests := []struct {
+		name       string
+		after      time.Duration
+		candidates map[string]string
+		failed     []string
+		wantDue    []string
+		wantLeaked int
+	}{
+		{"new orphans wait out the grace period", 0, orphans, nil, nil, 0},
+		{"still within the grace period", 9 * time.Minute, orphans, nil, nil, 0},
+		{"due after the grace period", 11 * time.Minute, orphans, []string{"b"}, []string{"db:a", "db:b"}, 1},
+		{"failed drop waits for its retry", 12 * time.Minute, map[string]string{"db:b": "b"}, nil, nil, 1},
+		{"retried after the backoff", 14 * time.Minute, map[string]string{"db:b": "b"}, nil, []string{"db:b"}, 0},
+	}
+
+	for _, tt := range tests {
+		now := start.Add(tt.after)
+		due, leaked := r.dueOrphans(tt.candidates, grace, now)
+		sort.Strings(due)
+		if !reflect.DeepEqual(due, tt.wantDue) {
+			t.Fatalf("%s: due = %v, want %v", tt.name, due, tt.wantDue)
+		}
+
+		failed := make(map[string]error)
+		for _, name := range tt.failed {
+			failed["db:"+name] = errDrop
+		}
+		r.recordDrops(due, failed, len(tt.candidates), leaked, now)
+		if stats := r.stats; stats.Leaked != tt.wantLeaked || stats.Orphans != len(tt.candidates) {
+			t.Errorf("%s: stats = %+v, want %d orphans, %d leaked", tt.name, stats, len(tt.candidates), tt.wantLeaked)
+		}
+	}
+
+	want := ReconcileStats{Runs: 5, LastRun: start.Add(14 * time.Minute), Orphans: 1, Dropped: 2, Failures: 1}
+	if r.stats != want {
+		t.Errorf("stats = %+v, want %+v", r.stats, want)
+	}
+	if len(r.orphans) != 0 {
+		t.Errorf("dropped orphans are still tracked: %v", r.orphans)
+	}
+}
+
+func TestReconcilerForgetsOwnedAgain(t *testing.T) {
+	r := newReconciler()
+	start := time.Now()
+
+	r.dueOrphans(map[string]string{"db:a": "a"}, time.Minute, start)
+
+	// The sandbox was owned again for a while, so its grace period starts over
+	r.dueOrphans(map[string]string{}, time.Minute, start.Add(30*time.Second))
+	due, _ := r.dueOrphans(map[string]string{"db:a": "a"}, time.Minute, start.Add(90*time.Second))
+	if len(due) != 0 {
+		t.Errorf("due = %v for an orphan seen again within the grace period", due)
+	}
+}
+
+func TestReconcilerBackoffCap(t *testing.T) {
+	r := newReconciler()
+	now := time.Now()
+	r.orphans["db:a"] = &orphan{firstSeen: now, attempts: 20}
+
+	r.recordDrops([]string{"db:a"}, map[string]error{"db:a": errors.New("fail")}, 1, 0, now)
+	if got := r.orphans["db:a"].retryAt.Sub(now); got != reconcileMaxBackoff {
+		t.Errorf("retry after %v, want %v", got, reconcileMaxBackoff)
+	}
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The session registry persists which sandbox database belongs to which
+// session in the base database, so sessions survive a server restart.
+
+// registryTable holds one row per session bound to a sandbox. Instances
+// sharing the base database only see their own rows.
+const registryTable = "querylab_sessions"
+
+// activitySaveInterval throttles how often last activity is written back
+const activitySaveInterval = time.Minute
+
+// openRegistry creates the registry tables in the base database
+func (s *SandboxManager) openRegistry() error {
+	db := s.base
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			session_id    text PRIMARY KEY,
+			instance_id   text NOT NULL,
+			db_name       text NOT NULL UNIQUE,
+			dataset_id    text NOT NULL,
+			created_at    timestamptz NOT NULL DEFAULT now(),
+			last_activity timestamptz NOT NULL
+		)`, registryTable))
+	if err == nil {
+		// Registries created before instance IDs existed
+		_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS instance_id text NOT NULL DEFAULT %s`,
+			registryTable, pq.QuoteLiteral(DefaultInstanceID)))
+	}
+	if err == nil {
+		_, err = db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				session_id text NOT NULL REFERENCES %s ON DELETE CASCADE,
+				name       text NOT NULL,
+				db_name    text NOT NULL UNIQUE,
+				created_at timestamptz NOT NULL,
+				PRIMARY KEY (session_id, name)
+			)`, snapshotTable, registryTable))
+	}
+	if err == nil {
+		_, err = db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				token          text PRIMARY KEY,
+				instance_id    text NOT NULL,
+				db_name        text NOT NULL UNIQUE,
+				dataset_id     text NOT NULL,
+				source_session text NOT NULL,
+				created_at     timestamptz NOT NULL,
+				expires_at     timestamptz NOT NULL
+			)`, forkTable))
+	}
+	if err != nil {
+		return err
+	}
+
+	s.registry = db
+	return nil
+}
+
+// loadRegistry restores the sessions of the registry and their snapshots.
+// Expired sessions and sessions whose database is gone are removed. Every restored sandbox role
+// gets a new password, since passwords are only kept in memory.
+func (s *SandboxManager) loadRegistry() {
+	rows, err := s.registry.Query(fmt.Sprintf(`
+		SELECT r.session_id, r.db_name, r.dataset_id, r.last_activity, d.datname IS NOT NULL
+		FROM %s r
+		LEFT JOIN pg_database d ON d.datname = r.db_name
+		WHERE r.instance_id = $1`, registryTable), s.config.InstanceID)
+	if err != nil {
+		slog.Error("failed to read session registry", "error", err)
+		return
+	}
+
+	type registered struct {
+		sessionID string
+		entry     *sandboxEntry
+		exists    bool
+	}
+	var all []registered
+	for rows.Next() {
+		var r registered
+		r.entry = &sandboxEntry{}
+		if err := rows.Scan(&r.sessionID, &r.entry.dbName, &r.entry.datasetID, &r.entry.lastActivity, &r.exists); err != nil {
+			slog.Error("failed to scan session registry row", "error", err)
+			continue
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+
+	snapshots, err := s.loadSnapshots()
+	if err != nil {
+		slog.Error("failed to read snapshot registry", "error", err)
+	}
+	for _, r := range all {
+		r.entry.snapshots = snapshots[r.sessionID]
+	}
+
+	cutoff := time.Now().Add(-s.config.SessionTimeout)
+	restored := 0
+	for _, r := range all {
+		switch {
+		case !r.exists:
+			slog.Info("forgetting session without database", "sessionID", r.sessionID, "dbName", r.entry.dbName)
+			s.unregisterSession(r.sessionID)
+			continue
+		case r.entry.lastActivity.Before(cutoff):
+			slog.Info("dropping session expired while stopped", "sessionID", r.sessionID, "dbName", r.entry.dbName)
+			s.destroySandbox(r.sessionID, r.entry)
+			continue
+		}
+
+		password, err := s.resetSandboxPassword(r.entry.dbName)
+		if err != nil {
+			slog.Error("failed to restore session", "sessionID", r.sessionID, "dbName", r.entry.dbName, "error", err)
+			s.destroySandbox(r.sessionID, r.entry)
+			continue
+		}
+		r.entry.password = password
+		r.entry.savedActivity = r.entry.lastActivity
+		s.sandboxes[r.sessionID] = r.entry
+		restored++
+	}
+
+	slog.Info("session registry loaded", "restored", restored, "registered", len(all))
+}
+
+// resetSandboxPassword gives the role of a sandbox a new random password
+func (s *SandboxManager) resetSandboxPassword(dbName string) (string, error) {
+	password, err := randomPassword()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.registry.Exec(fmt.Sprintf(`ALTER ROLE %s PASSWORD %s`, sandboxRole(dbName), pq.QuoteLiteral(password)))
+	return password, err
+}
+
+// registerSession records the sandbox of a session
+func (s *SandboxManager) registerSession(sessionID string, entry *sandboxEntry) {
+	if s.registry == nil {
+		return
+	}
+	_, err := s.registry.Exec(fmt.Sprintf(`
+		INSERT INTO %s (session_id, instance_id, db_name, dataset_id, last_activity)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (session_id) DO UPDATE
+		SET instance_id = EXCLUDED.instance_id,
+		    db_name = EXCLUDED.db_name,
+		    dataset_id = EXCLUDED.dataset_id,
+		    created_at = now(),
+		    last_activity = EXCLUDED.last_activity`, registryTable),
+		sessionID, s.config.InstanceID, entry.dbName, entry.datasetID, entry.lastActivity)
+	if err != nil {
+		slog.Error("failed to register session", "sessionID", sessionID, "dbName", entry.dbName, "error", err)
+	}
+}
+
+// unregisterSession removes a session from the registry
+func (s *SandboxManager) unregisterSession(sessionID string) {
+	if s.registry == nil {
+		return
+	}
+	if _, err := s.registry.Exec(fmt.Sprintf(`DELETE FROM %s WHERE session_id = $1`, registryTable), sessionID); err != nil {
+		slog.Error("failed to unregister session", "sessionID", sessionID, "error", err)
+	}
+}
+
+// touchLocked marks a session as active and writes the activity back to
+// the registry at most once per activitySaveInterval (s.mu must be held)
+func (s *SandboxManager) touchLocked(sessionID string, entry *sandboxEntry) {
+	now := time.Now()
+	entry.lastActivity = now
+	if s.registry == nil || now.Sub(entry.savedActivity) < activitySaveInterval {
+		return
+	}
+	entry.savedActivity = now
+
+	// Only update, a session removed in the meantime must stay removed
+	go func(db *sql.DB) {
+		_, err := db.Exec(fmt.Sprintf(`UPDATE %s SET last_activity = $2 WHERE session_id = $1`, registryTable), sessionID, now)
+		if err != nil {
+			slog.Warn("failed to save session activity", "sessionID", sessionID, "error", err)
+		}
+	}(s.registry)
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+
+	"github.com/lib/pq"
+)
+
+// Every sandbox database gets its own login role, so one session's
+// credentials can't reach another session's database.
+
+// sandboxRoleConnLimit caps the connections of a single sandbox role
+const sandboxRoleConnLimit = 10
+
+// Credentials are the login details of a sandbox's own role
+type Credentials struct {
+	Host     string
+	Port     string
+	DBName   string
+	User     string
+	Password string
+}
+
+// ConnString returns the lib/pq connection string for the credentials
+func (c Credentials) ConnString() string {
+	return fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		c.Host,
+		c.Port,
+		c.User,
+		c.Password, // hex, needs no quoting
+		c.DBName,
+	)
+}
+
+// sandboxRole returns the name of the login role of a sandbox database
+func sandboxRole(dbName string) string {
+	return dbName + "_user"
+}
+
+// Credentials returns the login details of a session's sandbox
+func (s *SandboxManager) Credentials(sessionID string) (Credentials, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.sandboxes[sessionID]
+	if !ok {
+		return Credentials{}, false
+	}
+	return s.credentialsOf(entry.dbName, entry.password), true
+}
+
+func (s *SandboxManager) credentialsOf(dbName, password string) Credentials {
+	return Credentials{
+		Host:     s.config.Host,
+		Port:     s.config.Port,
+		DBName:   dbName,
+		User:     sandboxRole(dbName),
+		Password: password,
+	}
+}
+
+// createSandboxRole creates the login role of a sandbox database with a
+// random password, which it returns
+func (s *SandboxManager) createSandboxRole(dbName string) (string, error) {
+	password, err := randomPassword()
+	if err != nil {
+		return "", err
+	}
+
+	db := s.base
+
+	_, err = db.Exec(fmt.Sprintf(`
+		CREATE ROLE %s LOGIN PASSWORD %s
+		NOSUPERUSER NOCREATEDB NOCREATEROLE NOINHERIT NOREPLICATION
+		CONNECTION LIMIT %d`,
+		sandboxRole(dbName), pq.QuoteLiteral(password), sandboxRoleConnLimit))
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.markOwned(db, "ROLE", sandboxRole(dbName)); err != nil {
+		_ = s.dropSandboxRole(dbName)
+		return "", err
+	}
+	return password, nil
+}
+
+// dropSandboxRole drops the login role of a sandbox database. The database
+// must be dropped first, the role still owns the objects the user created.
+func (s *SandboxManager) dropSandboxRole(dbName string) error {
+	db := s.base
+
+	role := sandboxRole(dbName)
+	if _, err := db.Exec(fmt.Sprintf("DROP ROLE IF EXISTS %s", role)); err != nil {
+		slog.Error("failed to drop role", "role", role, "error", err)
+		return err
+	}
+	return nil
+}
+
+// reassignSandboxObjects hands the objects one sandbox role owns in a
+// database over to another and drops the privileges left to the first,
+// so the database no longer depends on it. Reassigning needs the
+// privileges of both roles, which the admin grants itself. Dropping the
+// privileges takes those on databases with it, in every database.
+func (s *SandboxManager) reassignSandboxObjects(dbName, from, to string) error {
+	db, err := s.adminDB(dbName)
+	if err != nil {
+		slog.Error("failed to connect to db", "dbName", dbName, "error", err)
+		return err
+	}
+
+	stmts := []string{
+		fmt.Sprintf(`GRANT %s, %s TO %s`, from, to, s.config.AdminUser),
+		fmt.Sprintf(`REASSIGN OWNED BY %s TO %s`, from, to),
+		fmt.Sprintf(`DROP OWNED BY %s`, from),
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			slog.Error("reassign error", "statement", stmt, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// dropSandboxDB drops a sandbox database together with its role
+func (s *SandboxManager) dropSandboxDB(dbName string) error {
+	if err := s.dropDB(dbName); err != nil {
+		return err
+	}
+	return s.dropSandboxRole(dbName)
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
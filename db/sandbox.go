@@ -1,7 +1,9 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
@@ -19,80 +21,336 @@ type DBConfig struct {
 	AdminUser     string
 	AdminPassword string
 
-	SandboxUser     string
-	SandboxPassword string
-
-	BaseDB  string
-	InitSQL string
+	InstanceID  string // Namespaces the databases and roles of this instance
+	BaseDB      string
+	InitSQL     string
+	DatasetsDir string // Directory of additional *.sql datasets
 
 	SessionTimeout time.Duration // Timeout for session cleanup
+	PoolSize       int           // Number of ready sandboxes to keep, 0 disables the pool
+	MaxSnapshots   int           // Snapshots a session may keep
+	ForkTTL        time.Duration // How long a fork can be redeemed
+	MaxConnections int           // Cap on open sandbox connections, 0 for none
+
+	StatefulIdleTimeout time.Duration // How long a stateful session's connection may sit idle
+
+	ReconcileInterval time.Duration // How often to look for orphaned sandboxes
+	OrphanGracePeriod time.Duration // How long a sandbox may be unowned before it is dropped
+
+	Limits Limits // Default resource limits, datasets can override them
 }
 
 type SandboxManager struct {
 	mu        sync.RWMutex
 	sandboxes map[string]*sandboxEntry
+	inflight  map[string]*provisionCall // sessions currently being provisioned
 	config    *DBConfig
+	datasets  *DatasetCatalog
+
+	tplMu     sync.Mutex
+	templates map[string]*templateState // keyed by dataset ID
+
+	pool *warmPool // nil when pooling is disabled
+
+	forkMu sync.Mutex
+	forks  map[string]*Fork // keyed by token
+
+	base  *sql.DB    // admin connections to the base database
+	conns *connCache // connections to the sandboxes, as their roles
+
+	stickyMu sync.Mutex
+	sticky   map[string]*stickyConn // sessions in stateful mode
+	registry *sql.DB                // base database holding the session registry, nil if unavailable
+
+	reconciler *reconciler
 }
 
 type sandboxEntry struct {
 	dbName       string
+	password     string // of the sandbox's login role
+	datasetID    string
 	lastActivity time.Time
+
+	savedActivity time.Time // last activity as written to the registry
+
+	snapshots []*Snapshot // guarded by the manager's mu
+	ops       sync.Mutex  // serializes snapshot operations on the sandbox
+}
+
+// sandbox is a provisioned sandbox database not yet bound to a session
+type sandbox struct {
+	dbName   string
+	password string // of the sandbox's login role
+	template string // template the database was cloned from, empty if none
+}
+
+// provisionCall is an in-flight sandbox creation for one session.
+// Callers asking for the same session wait on done and share the result.
+type provisionCall struct {
+	done      chan struct{}
+	datasetID string
+	sandbox   *sandbox
+	dbName    string
+	err       error
+	abandoned bool // session was cleaned up before provisioning finished
 }
 
+var errSessionClosed = errors.New("session was closed during provisioning")
+
 func NewSandboxManager(cfg *DBConfig) *SandboxManager {
+	cfg.InstanceID = checkInstanceID(cfg.InstanceID)
 	if cfg.SessionTimeout == 0 {
 		cfg.SessionTimeout = 1 * time.Hour // Default 1 hour
 	}
+	if cfg.ReconcileInterval == 0 {
+		cfg.ReconcileInterval = 5 * time.Minute
+	}
+	if cfg.OrphanGracePeriod == 0 {
+		cfg.OrphanGracePeriod = 10 * time.Minute
+	}
+	if cfg.ForkTTL == 0 {
+		cfg.ForkTTL = 24 * time.Hour
+	}
+	if cfg.StatefulIdleTimeout == 0 {
+		cfg.StatefulIdleTimeout = 5 * time.Minute
+	}
+
+	datasets, err := LoadDatasets(cfg.InitSQL, cfg.DatasetsDir)
+	if err != nil {
+		slog.Error("failed to load datasets, only the default dataset is available", "error", err)
+		datasets, _ = LoadDatasets(cfg.InitSQL, "")
+	}
+	slog.Info("datasets loaded", "count", len(datasets.order))
 
 	sm := &SandboxManager{
 		sandboxes: make(map[string]*sandboxEntry),
+		inflight:  make(map[string]*provisionCall),
 		config:    cfg,
+		datasets:  datasets,
+		templates: make(map[string]*templateState),
+		forks:     make(map[string]*Fork),
+		conns:     newConnCache(cfg.MaxConnections),
+		sticky:    make(map[string]*stickyConn),
+
+		reconciler: newReconciler(),
+	}
+
+	// sql.Open only fails for an unknown driver
+	sm.base, _ = sm.adminConn(cfg.BaseDB)
+	sm.base.SetMaxIdleConns(baseMaxIdleConns)
+
+	// Restore the sessions and forks of the previous run, then drop the
+	// sandboxes nobody owns. Without the registry every sandbox is unowned.
+	if err := sm.openRegistry(); err != nil {
+		slog.Error("session registry unavailable, sessions won't survive restarts", "error", err)
+	} else {
+		sm.loadRegistry()
+		sm.loadForks()
 	}
+	sm.reconcile(0)
+
+	// Build the template databases before the first session needs them
+	sm.prepareTemplates()
 
-	// Start cleanup goroutine
+	if cfg.PoolSize > 0 {
+		sm.pool = newWarmPool(cfg.PoolSize)
+		go sm.runPool()
+	}
+
+	// Start cleanup goroutines
 	go sm.cleanupOldSandboxes()
+	go sm.runReconciler()
 
 	return sm
 }
 
-func (s *SandboxManager) GetOrCreateSession(sessionID string) (string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Close drops the pooled sandboxes, which no session owns, and closes all
+// connections. Session sandboxes are kept for the next run, which restores
+// them from the registry.
+func (s *SandboxManager) Close() {
+	if s.pool != nil {
+		s.drainPool()
+	}
 
-	// If session already exists, just return the existing DB
-	if entry, exists := s.sandboxes[sessionID]; exists {
-		// Update last activity to keep session alive
-		entry.lastActivity = time.Now()
-		return entry.dbName, nil
+	s.conns.mu.Lock()
+	for name, p := range s.conns.pools {
+		p.db.Close()
+		delete(s.conns.pools, name)
 	}
+	for name, db := range s.conns.admin {
+		db.Close()
+		delete(s.conns.admin, name)
+	}
+	s.conns.mu.Unlock()
 
-	// Otherwise, create a new sandbox database
-	dbName := "sandbox_" + s.randomString(6)
+	s.base.Close()
+}
 
-	if err := s.createDB(dbName); err != nil {
-		slog.Error("failed to create database", "dbName", dbName, "error", err)
+// GetOrCreateSession returns the sandbox database of a session, creating it
+// from the given dataset if needed. An empty datasetID keeps the session's
+// current dataset, or uses the default one for new sessions. Asking for a
+// different dataset than the session has re-provisions its sandbox.
+//
+// Provisioning runs without holding the manager lock, so creates for
+// different sessions run in parallel and concurrent creates for the same
+// session share a single provisioning call.
+func (s *SandboxManager) GetOrCreateSession(sessionID, datasetID string) (string, error) {
+	ds, err := s.datasets.Get(datasetID)
+	if err != nil {
 		return "", err
 	}
 
-	if err := s.initDB(dbName); err != nil {
-		slog.Error("failed to init database", "dbName", dbName, "error", err)
-		_ = s.dropDB(dbName)
-		return "", err
+	for {
+		s.mu.Lock()
+
+		// If session already exists with the wanted dataset, just return the existing DB
+		if entry, exists := s.sandboxes[sessionID]; exists && (datasetID == "" || entry.datasetID == ds.ID) {
+			// Update last activity to keep session alive
+			s.touchLocked(sessionID, entry)
+			s.mu.Unlock()
+			return entry.dbName, nil
+		}
+
+		// If the session is already being provisioned, wait for that result
+		if call, ok := s.inflight[sessionID]; ok {
+			s.mu.Unlock()
+			<-call.done
+			if call.err != nil || datasetID == "" || call.datasetID == ds.ID {
+				return call.dbName, call.err
+			}
+			// A different dataset was requested, provision again
+			continue
+		}
+
+		call := &provisionCall{done: make(chan struct{}), datasetID: ds.ID}
+		s.inflight[sessionID] = call
+		s.mu.Unlock()
+
+		return s.runProvision(sessionID, call, func() (*sandbox, error) {
+			return s.sandboxFor(ds)
+		})
 	}
+}
 
-	if err := s.grantSandboxPrivileges(dbName); err != nil {
-		slog.Error("failed to grant sandbox privileges", "dbName", dbName, "error", err)
-		_ = s.dropDB(dbName)
+// ResetSession replaces the sandbox of a session with a fresh copy of its
+// dataset, keeping the session itself. It returns the new database name.
+func (s *SandboxManager) ResetSession(sessionID string) (string, error) {
+	s.mu.Lock()
+
+	// A sandbox being provisioned right now is fresh already
+	if call, ok := s.inflight[sessionID]; ok {
+		s.mu.Unlock()
+		<-call.done
+		return call.dbName, call.err
+	}
+
+	entry, ok := s.sandboxes[sessionID]
+	if !ok {
+		s.mu.Unlock()
+		return "", ErrSessionNotFound
+	}
+	ds, err := s.datasets.Get(entry.datasetID)
+	if err != nil {
+		s.mu.Unlock()
 		return "", err
 	}
 
-	// Store the new sandbox
-	s.sandboxes[sessionID] = &sandboxEntry{
-		dbName:       dbName,
-		lastActivity: time.Now(),
+	call := &provisionCall{done: make(chan struct{}), datasetID: ds.ID}
+	s.inflight[sessionID] = call
+	s.mu.Unlock()
+
+	slog.Info("resetting session sandbox", "sessionID", sessionID, "dbName", entry.dbName, "dataset", ds.ID)
+	return s.runProvision(sessionID, call, func() (*sandbox, error) {
+		return s.sandboxFor(ds)
+	})
+}
+
+// runProvision creates a sandbox for an in-flight call and binds it to the
+// session, replacing (and dropping) the sandbox the session had before
+func (s *SandboxManager) runProvision(sessionID string, call *provisionCall, create func() (*sandbox, error)) (string, error) {
+	call.sandbox, call.err = create()
+	if call.err == nil {
+		call.dbName = call.sandbox.dbName
+	}
+
+	s.mu.Lock()
+	delete(s.inflight, sessionID)
+	abandoned := call.abandoned
+	var replaced, stored *sandboxEntry
+	if call.err == nil && !abandoned {
+		replaced = s.sandboxes[sessionID]
+		// Store the new sandbox
+		now := time.Now()
+		stored = &sandboxEntry{
+			dbName:        call.dbName,
+			password:      call.sandbox.password,
+			datasetID:     call.datasetID,
+			lastActivity:  now,
+			savedActivity: now,
+		}
+		s.sandboxes[sessionID] = stored
+	}
+	s.mu.Unlock()
+
+	if stored != nil {
+		s.registerSession(sessionID, stored)
+	}
+
+	if replaced != nil {
+		slog.Info("replaced session sandbox",
+			"sessionID", sessionID,
+			"oldDBName", replaced.dbName,
+			"dbName", call.dbName,
+			"dataset", call.datasetID,
+		)
+		if err := s.dropSandbox(replaced); err != nil {
+			slog.Warn("failed to drop replaced sandbox", "dbName", replaced.dbName, "error", err)
+		}
+		// Dropping the old sandbox terminated the session's own connection
+		s.markStickyDirty(sessionID)
+	}
+
+	if call.err == nil && abandoned {
+		// The session was cleaned up while we were provisioning it
+		slog.Info("dropping sandbox of session cleaned up during provisioning",
+			"sessionID", sessionID,
+			"dbName", call.dbName,
+		)
+		_ = s.dropSandboxDB(call.dbName)
+		call.dbName, call.err = "", errSessionClosed
 	}
+	close(call.done)
 
-	return dbName, nil
+	return call.dbName, call.err
+}
+
+// sandboxFor returns a new sandbox for a dataset, taking it from the warm
+// pool when possible (the pool only holds the default dataset)
+func (s *SandboxManager) sandboxFor(ds *Dataset) (*sandbox, error) {
+	if ds.Default {
+		if sb, ok := s.takePooled(); ok {
+			return sb, nil
+		}
+	}
+
+	return s.newSandbox(ds)
+}
+
+// Datasets returns the catalog of datasets sessions can choose from
+func (s *SandboxManager) Datasets() *DatasetCatalog {
+	return s.datasets
+}
+
+// GetDataset returns the dataset ID of a session
+func (s *SandboxManager) GetDataset(sessionID string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.sandboxes[sessionID]
+	if !ok {
+		return "", false
+	}
+	return entry.datasetID, true
 }
 
 // UpdateSessionActivity updates the last activity time for a session
@@ -102,7 +360,7 @@ func (s *SandboxManager) UpdateSessionActivity(sessionID string) {
 	defer s.mu.Unlock()
 
 	if entry, exists := s.sandboxes[sessionID]; exists {
-		entry.lastActivity = time.Now()
+		s.touchLocked(sessionID, entry)
 	}
 }
 
@@ -122,22 +380,50 @@ func (s *SandboxManager) GetDB(sessionID string) (string, bool) {
 // Call this when user explicitly logs out or exits
 func (s *SandboxManager) CleanupSession(sessionID string) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	entry := s.detachSessionLocked(sessionID)
+	s.mu.Unlock()
 
-	return s.cleanupSessionLocked(sessionID)
+	if entry != nil {
+		s.destroySandbox(sessionID, entry)
+	}
+	return nil
 }
 
-// cleanupSessionLocked does the actual cleanup (assumes lock is already held)
-func (s *SandboxManager) cleanupSessionLocked(sessionID string) error {
-	if entry, exists := s.sandboxes[sessionID]; exists {
-		if err := s.dropDB(entry.dbName); err != nil {
-			slog.Warn("failed to drop database on cleanup", "dbName", entry.dbName, "error", err)
-			// Continue to delete the entry even if drop fails
-		}
-		delete(s.sandboxes, sessionID)
-		slog.Info("cleaned up session", "sessionID", sessionID, "dbName", entry.dbName)
+// detachSessionLocked removes a session from the manager and returns its
+// entry so the database can be dropped after the lock is released.
+// A session that is still being provisioned is marked as abandoned.
+func (s *SandboxManager) detachSessionLocked(sessionID string) *sandboxEntry {
+	if call, ok := s.inflight[sessionID]; ok {
+		call.abandoned = true
 	}
-	return nil
+
+	entry, exists := s.sandboxes[sessionID]
+	if !exists {
+		return nil
+	}
+	delete(s.sandboxes, sessionID)
+	return entry
+}
+
+// destroySandbox unregisters a detached session and drops its database
+// (lock must not be held)
+func (s *SandboxManager) destroySandbox(sessionID string, entry *sandboxEntry) {
+	s.dropSticky(sessionID)
+	s.unregisterSession(sessionID)
+	if err := s.dropSandbox(entry); err != nil {
+		slog.Warn("failed to drop database on cleanup", "dbName", entry.dbName, "error", err)
+	}
+	slog.Info("cleaned up session", "sessionID", sessionID, "dbName", entry.dbName)
+}
+
+// dropSandbox drops everything belonging to a sandbox entry
+func (s *SandboxManager) dropSandbox(entry *sandboxEntry) error {
+	// Wait for a running snapshot operation, it may still add a snapshot
+	entry.ops.Lock()
+	defer entry.ops.Unlock()
+
+	s.dropSnapshots(entry)
+	return s.dropSandboxDB(entry.dbName)
 }
 
 // cleanupOldSandboxes periodically cleans up inactive sessions
@@ -155,7 +441,6 @@ func (s *SandboxManager) cleanupOldSandboxes() {
 // cleanupInactiveSessions removes sessions that have been inactive too long
 func (s *SandboxManager) cleanupInactiveSessions() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	cutoff := time.Now().Add(-s.config.SessionTimeout)
 	var toDelete []string
@@ -178,13 +463,22 @@ func (s *SandboxManager) cleanupInactiveSessions() {
 		}
 	}
 
+	expired := make(map[string]*sandboxEntry, len(toDelete))
 	for _, sessionID := range toDelete {
-		_ = s.cleanupSessionLocked(sessionID)
+		expired[sessionID] = s.detachSessionLocked(sessionID)
+	}
+	s.mu.Unlock()
+
+	// Drop databases without blocking query traffic
+	for sessionID, entry := range expired {
+		s.destroySandbox(sessionID, entry)
 	}
 
 	if len(toDelete) > 0 {
 		slog.Info("cleaned up inactive sessions", "count", len(toDelete))
 	}
+
+	s.dropExpiredForks()
 }
 
 // GenerateSessionID generates a unique session ID
@@ -209,15 +503,28 @@ func (s *SandboxManager) adminConn(dbName string) (*sql.DB, error) {
 	return sql.Open("postgres", conn)
 }
 
-func (s *SandboxManager) createDB(name string) error {
-	db, err := s.adminConn(s.config.BaseDB)
+// CancelBackend cancels the statement running on a backend of the session's
+// sandbox. The sandbox role may signal its own backends, so no extra
+// privileges are needed. It reports whether the backend was signalled.
+func (s *SandboxManager) CancelBackend(ctx context.Context, sessionID string, pid int) (bool, error) {
+	db, err := s.sandboxDB(sessionID)
 	if err != nil {
-		slog.Error("failed to connect to base db", "dbName", s.config.BaseDB, "error", err)
-		return err
+		return false, err
 	}
-	defer db.Close()
 
-	_, err = db.Exec(fmt.Sprintf(
+	// Only backends of this sandbox database can be targeted
+	var signalled bool
+	err = db.QueryRowContext(ctx, `
+		SELECT coalesce(bool_or(pg_cancel_backend(pid)), false)
+		FROM pg_stat_activity
+		WHERE pid = $1 AND datname = current_database()`, pid).Scan(&signalled)
+	return signalled, err
+}
+
+func (s *SandboxManager) createDB(name string) error {
+	db := s.base
+
+	_, err := db.Exec(fmt.Sprintf(
 		"CREATE DATABASE %s OWNER %s",
 		name,
 		s.config.AdminUser,
@@ -226,15 +533,11 @@ func (s *SandboxManager) createDB(name string) error {
 }
 
 func (s *SandboxManager) dropDB(name string) error {
-	db, err := s.adminConn(s.config.BaseDB)
-	if err != nil {
-		slog.Error("failed to connect to base db", "dbName", s.config.BaseDB, "error", err)
-		return err
-	}
-	defer db.Close()
+	s.evictConns(name)
+	db := s.base
 
 	// Terminate all connections to the target database
-	_, err = db.Exec(fmt.Sprintf(`
+	_, err := db.Exec(fmt.Sprintf(`
 		SELECT pg_terminate_backend(pid)
 		FROM pg_stat_activity
 		WHERE datname = '%s' AND pid <> pg_backend_pid()`, name))
@@ -253,17 +556,79 @@ func (s *SandboxManager) dropDB(name string) error {
 	return nil
 }
 
-func (s *SandboxManager) initDB(name string) error {
-	db, err := s.adminConn(name)
+// newSandbox creates a fully provisioned sandbox database for a dataset,
+// with its own login role, that is not yet bound to a session
+func (s *SandboxManager) newSandbox(ds *Dataset) (*sandbox, error) {
+	dbName := s.sandboxPrefix() + s.randomString(6)
+
+	tplName, err := s.provisionDB(dbName, ds)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.claimDatabase(dbName); err != nil {
+		slog.Error("failed to mark sandbox as owned", "dbName", dbName, "error", err)
+		_ = s.dropDB(dbName)
+		return nil, err
+	}
+
+	password, err := s.createSandboxRole(dbName)
+	if err != nil {
+		slog.Error("failed to create sandbox role", "dbName", dbName, "error", err)
+		_ = s.dropDB(dbName)
+		return nil, err
+	}
+
+	if err := s.grantSandboxPrivileges(dbName); err != nil {
+		slog.Error("failed to grant sandbox privileges", "dbName", dbName, "error", err)
+		_ = s.dropSandboxDB(dbName)
+		return nil, err
+	}
+
+	if err := s.applyLimits(dbName, s.limitsFor(ds)); err != nil {
+		slog.Error("failed to apply sandbox limits", "dbName", dbName, "error", err)
+		_ = s.dropSandboxDB(dbName)
+		return nil, err
+	}
+
+	return &sandbox{dbName: dbName, password: password, template: tplName}, nil
+}
+
+// provisionDB creates a sandbox database holding the data of a dataset.
+// It clones the prepared template and only falls back to running the
+// SQL directly when the template is unavailable.
+func (s *SandboxManager) provisionDB(dbName string, ds *Dataset) (string, error) {
+	tplName, err := s.cloneFromTemplate(dbName, ds)
+	if err == nil {
+		return tplName, nil
+	}
+	slog.Warn("failed to clone template, running init SQL instead", "dbName", dbName, "error", err)
+	_ = s.dropDB(dbName)
+
+	if err := s.createDB(dbName); err != nil {
+		slog.Error("failed to create database", "dbName", dbName, "error", err)
+		return "", err
+	}
+
+	if err := s.initDB(dbName, ds.Path); err != nil {
+		slog.Error("failed to init database", "dbName", dbName, "error", err)
+		_ = s.dropDB(dbName)
+		return "", err
+	}
+
+	return "", nil
+}
+
+func (s *SandboxManager) initDB(name, sqlPath string) error {
+	db, err := s.adminDB(name)
 	if err != nil {
 		slog.Error("failed to connect to db", "dbName", name, "error", err)
 		return err
 	}
-	defer db.Close()
 
-	sqlBytes, err := os.ReadFile(s.config.InitSQL)
+	sqlBytes, err := os.ReadFile(sqlPath)
 	if err != nil {
-		slog.Error("failed to read init SQL file", "file", s.config.InitSQL, "error", err)
+		slog.Error("failed to read init SQL file", "file", sqlPath, "error", err)
 		return err
 	}
 
@@ -272,38 +637,41 @@ func (s *SandboxManager) initDB(name string) error {
 }
 
 func (s *SandboxManager) grantSandboxPrivileges(dbName string) error {
-	db, err := s.adminConn(dbName)
+	db, err := s.adminDB(dbName)
 	if err != nil {
 		slog.Error("failed to connect to db", "dbName", dbName, "error", err)
 		return err
 	}
-	defer db.Close()
 
+	role := sandboxRole(dbName)
 	stmts := []string{
+		// Only the sandbox's own role may connect, not every role through PUBLIC
+		fmt.Sprintf(`REVOKE ALL ON DATABASE %s FROM PUBLIC`, dbName),
+
 		// Allow user to connect and create temp tables
-		fmt.Sprintf(`GRANT CONNECT, TEMP ON DATABASE %s TO %s`, dbName, s.config.SandboxUser),
+		fmt.Sprintf(`GRANT CONNECT, TEMP ON DATABASE %s TO %s`, dbName, role),
 
 		// Schema privileges: allow usage and object creation
-		fmt.Sprintf(`GRANT USAGE, CREATE ON SCHEMA public TO %s`, s.config.SandboxUser),
+		fmt.Sprintf(`GRANT USAGE, CREATE ON SCHEMA public TO %s`, role),
 
 		// Table privileges: full DML on existing tables
-		fmt.Sprintf(`GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO %s`, s.config.SandboxUser),
+		fmt.Sprintf(`GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO %s`, role),
 
 		// Sequence privileges (needed for SERIAL/IDENTITY)
-		fmt.Sprintf(`GRANT USAGE, SELECT, UPDATE ON ALL SEQUENCES IN SCHEMA public TO %s`, s.config.SandboxUser),
+		fmt.Sprintf(`GRANT USAGE, SELECT, UPDATE ON ALL SEQUENCES IN SCHEMA public TO %s`, role),
 
 		// Default privileges for future tables
 		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES IN SCHEMA public
-                    GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO %s`, s.config.SandboxUser),
+                    GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO %s`, role),
 
 		// Default privileges for future sequences
 		fmt.Sprintf(`ALTER DEFAULT PRIVILEGES IN SCHEMA public
-                    GRANT USAGE, SELECT, UPDATE ON SEQUENCES TO %s`, s.config.SandboxUser),
+                    GRANT USAGE, SELECT, UPDATE ON SEQUENCES TO %s`, role),
 
 		// Optional: revoke dangerous access (just in case)
-		fmt.Sprintf(`REVOKE ALL ON DATABASE postgres FROM %s`, s.config.SandboxUser),
-		fmt.Sprintf(`REVOKE CREATE ON SCHEMA pg_catalog FROM %s`, s.config.SandboxUser),
-		fmt.Sprintf(`REVOKE ALL ON SCHEMA information_schema FROM %s`, s.config.SandboxUser),
+		fmt.Sprintf(`REVOKE ALL ON DATABASE postgres FROM %s`, role),
+		fmt.Sprintf(`REVOKE CREATE ON SCHEMA pg_catalog FROM %s`, role),
+		fmt.Sprintf(`REVOKE ALL ON SCHEMA information_schema FROM %s`, role),
 	}
 
 	for _, stmt := range stmts {
@@ -313,20 +681,6 @@ func (s *SandboxManager) grantSandboxPrivileges(dbName string) error {
 		}
 	}
 
-	// Optional: apply per-user safe defaults
-	defaultSettings := []string{
-		fmt.Sprintf(`ALTER ROLE %s SET statement_timeout = '3000ms'`, s.config.SandboxUser),
-		fmt.Sprintf(`ALTER ROLE %s SET work_mem = '16MB'`, s.config.SandboxUser),
-		fmt.Sprintf(`ALTER ROLE %s SET allow_system_table_mods = off`, s.config.SandboxUser),
-	}
-
-	for _, stmt := range defaultSettings {
-		if _, err := db.Exec(stmt); err != nil {
-			slog.Error("default setting error", "statement", stmt, "error", err)
-			return err
-		}
-	}
-
 	return nil
 }
 
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/lib/pq"
+)
+
+// ErrSessionNotFound is returned for operations on a session that has no sandbox
+var ErrSessionNotFound = errors.New("session not found")
+
+// Schema describes the user-visible tables of a sandbox database
+type Schema struct {
+	Database string  `json:"database"`
+	Dataset  string  `json:"dataset"`
+	Tables   []Table `json:"tables"`
+}
+
+type Table struct {
+	Schema      string        `json:"schema"`
+	Name        string        `json:"name"`
+	Columns     []TableColumn `json:"columns"`
+	PrimaryKey  []string      `json:"primary_key"`
+	ForeignKeys []ForeignKey  `json:"foreign_keys"`
+	Indexes     []Index       `json:"indexes"`
+	RowCount    *int64        `json:"row_count"` // nil if the table could not be counted
+}
+
+type TableColumn struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Nullable bool    `json:"nullable"`
+	Default  *string `json:"default,omitempty"`
+}
+
+type ForeignKey struct {
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	RefSchema  string   `json:"ref_schema"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+}
+
+type Index struct {
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	Unique     bool     `json:"unique"`
+	Primary    bool     `json:"primary"`
+	Definition string   `json:"definition"`
+}
+
+// userTablesFilter restricts pg_class c / pg_namespace n to ordinary and
+// partitioned tables outside of the system schemas
+const userTablesFilter = `
+	c.relkind IN ('r', 'p')
+	AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname NOT LIKE 'pg_toast%'
+	AND n.nspname NOT LIKE 'pg_temp%'`
+
+// DescribeSchema reads the catalog of a session's sandbox database.
+// It connects as the sandbox's role so tables created by the user can be counted.
+func (s *SandboxManager) DescribeSchema(ctx context.Context, sessionID string) (*Schema, error) {
+	dbName, ok := s.GetDB(sessionID)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	dataset, _ := s.GetDataset(sessionID)
+
+	db, err := s.sandboxDB(sessionID)
+	if err != nil {
+		slog.Error("failed to connect to db", "dbName", dbName, "error", err)
+		return nil, err
+	}
+
+	schema := &Schema{Database: dbName, Dataset: dataset, Tables: []Table{}}
+	tables := make(map[uint32]*Table)
+
+	if err := s.loadTables(ctx, db, schema, tables); err != nil {
+		return nil, fmt.Errorf("load tables: %w", err)
+	}
+	if err := s.loadColumns(ctx, db, tables); err != nil {
+		return nil, fmt.Errorf("load columns: %w", err)
+	}
+	if err := s.loadConstraints(ctx, db, tables); err != nil {
+		return nil, fmt.Errorf("load constraints: %w", err)
+	}
+	if err := s.loadIndexes(ctx, db, tables); err != nil {
+		return nil, fmt.Errorf("load indexes: %w", err)
+	}
+
+	for i := range schema.Tables {
+		t := &schema.Tables[i]
+		var count int64
+		query := fmt.Sprintf("SELECT count(*) FROM %s.%s", pq.QuoteIdentifier(t.Schema), pq.QuoteIdentifier(t.Name))
+		if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+			slog.Warn("failed to count table rows", "dbName", dbName, "table", t.Name, "error", err)
+			continue
+		}
+		t.RowCount = &count
+	}
+
+	return schema, nil
+}
+
+func (s *SandboxManager) loadTables(ctx context.Context, db *sql.DB, schema *Schema, tables map[uint32]*Table) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.oid, n.nspname, c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE `+userTablesFilter+`
+		ORDER BY n.nspname, c.relname`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var oids []uint32
+	for rows.Next() {
+		var oid uint32
+		t := Table{
+			Columns:     []TableColumn{},
+			PrimaryKey:  []string{},
+			ForeignKeys: []ForeignKey{},
+			Indexes:     []Index{},
+		}
+		if err := rows.Scan(&oid, &t.Schema, &t.Name); err != nil {
+			return err
+		}
+		schema.Tables = append(schema.Tables, t)
+		oids = append(oids, oid)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Index the slice only after it stopped growing
+	for i, oid := range oids {
+		tables[oid] = &schema.Tables[i]
+	}
+	return nil
+}
+
+func (s *SandboxManager) loadColumns(ctx context.Context, db *sql.DB, tables map[uint32]*Table) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.attrelid, a.attname, format_type(a.atttypid, a.atttypmod),
+		       NOT a.attnotnull, pg_get_expr(d.adbin, d.adrelid)
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE `+userTablesFilter+`
+		  AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attrelid, a.attnum`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid uint32
+		var col TableColumn
+		var def sql.NullString
+		if err := rows.Scan(&oid, &col.Name, &col.Type, &col.Nullable, &def); err != nil {
+			return err
+		}
+		if def.Valid {
+			col.Default = &def.String
+		}
+		if t, ok := tables[oid]; ok {
+			t.Columns = append(t.Columns, col)
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SandboxManager) loadConstraints(ctx context.Context, db *sql.DB, tables map[uint32]*Table) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT con.conrelid, con.conname, con.contype,
+		       ARRAY(SELECT a.attname
+		             FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord)
+		             JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+		             ORDER BY k.ord)::text[],
+		       coalesce(rn.nspname, ''), coalesce(rc.relname, ''),
+		       ARRAY(SELECT a.attname
+		             FROM unnest(con.confkey) WITH ORDINALITY k(attnum, ord)
+		             JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum
+		             ORDER BY k.ord)::text[]
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_class rc ON rc.oid = con.confrelid
+		LEFT JOIN pg_namespace rn ON rn.oid = rc.relnamespace
+		WHERE `+userTablesFilter+`
+		  AND con.contype IN ('p', 'f')
+		ORDER BY con.conrelid, con.conname`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid uint32
+		var name, kind, refSchema, refTable string
+		var cols, refCols []string
+		if err := rows.Scan(&oid, &name, &kind, pq.Array(&cols), &refSchema, &refTable, pq.Array(&refCols)); err != nil {
+			return err
+		}
+		t, ok := tables[oid]
+		if !ok {
+			continue
+		}
+
+		switch kind {
+		case "p":
+			t.PrimaryKey = cols
+		case "f":
+			t.ForeignKeys = append(t.ForeignKeys, ForeignKey{
+				Name:       name,
+				Columns:    cols,
+				RefSchema:  refSchema,
+				RefTable:   refTable,
+				RefColumns: refCols,
+			})
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SandboxManager) loadIndexes(ctx context.Context, db *sql.DB, tables map[uint32]*Table) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT i.indrelid, ic.relname, i.indisunique, i.indisprimary,
+		       pg_get_indexdef(i.indexrelid),
+		       ARRAY(SELECT a.attname
+		             FROM unnest(i.indkey::int2[]) WITH ORDINALITY k(attnum, ord)
+		             JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+		             ORDER BY k.ord)::text[]
+		FROM pg_index i
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_class c ON c.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE `+userTablesFilter+`
+		ORDER BY i.indrelid, ic.relname`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid uint32
+		var idx Index
+		if err := rows.Scan(&oid, &idx.Name, &idx.Unique, &idx.Primary, &idx.Definition, pq.Array(&idx.Columns)); err != nil {
+			return err
+		}
+		if t, ok := tables[oid]; ok {
+			t.Indexes = append(t.Indexes, idx)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,381 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+)
+
+// Snapshots are copies of a session's sandbox database, made by cloning it
+// as a template. They belong to the sandbox: resetting the session or
+// switching its dataset drops them. Restoring happens in place so the
+// objects keep belonging to the sandbox's role.
+
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrSnapshotExists   = errors.New("a snapshot with this name already exists")
+	ErrSnapshotQuota    = errors.New("snapshot quota reached")
+	ErrSnapshotName     = errors.New("snapshot names are 1-40 letters, digits, spaces, _ or -")
+)
+
+var validSnapshotName = regexp.MustCompile(`^[A-Za-z0-9 _-]{1,40}$`)
+
+// snapshotTable holds the snapshots of the sessions in the registry
+const snapshotTable = "querylab_snapshots"
+
+// Snapshot is a saved state of a session's sandbox
+type Snapshot struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+
+	dbName string
+}
+
+// CreateSnapshot saves the current state of a session's sandbox under a
+// name. Connections to the sandbox are closed while it is copied.
+func (s *SandboxManager) CreateSnapshot(sessionID, name string) (Snapshot, error) {
+	if !validSnapshotName.MatchString(name) {
+		return Snapshot{}, ErrSnapshotName
+	}
+
+	entry, err := s.lockEntry(sessionID)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer entry.ops.Unlock()
+	// Copying terminates the connections to the sandbox
+	defer s.markStickyDirty(sessionID)
+
+	s.mu.RLock()
+	count := len(entry.snapshots)
+	_, exists := findSnapshot(entry, name)
+	s.mu.RUnlock()
+	if exists {
+		return Snapshot{}, ErrSnapshotExists
+	}
+	if count >= s.config.MaxSnapshots {
+		return Snapshot{}, fmt.Errorf("%w: at most %d per session", ErrSnapshotQuota, s.config.MaxSnapshots)
+	}
+
+	snap := &Snapshot{
+		Name:      name,
+		CreatedAt: time.Now(),
+		dbName:    entry.dbName + "_snap_" + s.randomString(4),
+	}
+
+	db := s.base
+
+	if err := s.copyDatabase(db, entry.dbName, snap.dbName); err != nil {
+		slog.Error("failed to copy sandbox", "dbName", entry.dbName, "snapshot", snap.dbName, "error", err)
+		_ = s.dropDB(snap.dbName)
+		return Snapshot{}, err
+	}
+
+	// Like templates, snapshots are never connected to
+	_, err = db.Exec(fmt.Sprintf(`ALTER DATABASE %s ALLOW_CONNECTIONS false`, snap.dbName))
+	if err == nil {
+		err = s.markOwned(db, "DATABASE", snap.dbName)
+	}
+	if err != nil {
+		slog.Error("snapshot finalize error", "dbName", snap.dbName, "error", err)
+		_ = s.dropDB(snap.dbName)
+		return Snapshot{}, err
+	}
+
+	s.mu.Lock()
+	entry.snapshots = append(entry.snapshots, snap)
+	s.mu.Unlock()
+	s.registerSnapshot(sessionID, snap)
+
+	slog.Info("snapshot created", "sessionID", sessionID, "snapshot", name, "dbName", snap.dbName)
+	return *snap, nil
+}
+
+// ListSnapshots returns the snapshots of a session, oldest first
+func (s *SandboxManager) ListSnapshots(sessionID string) ([]Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.sandboxes[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	out := make([]Snapshot, 0, len(entry.snapshots))
+	for _, snap := range entry.snapshots {
+		out = append(out, *snap)
+	}
+	return out, nil
+}
+
+// MaxSnapshots returns how many snapshots a session may keep
+func (s *SandboxManager) MaxSnapshots() int {
+	return s.config.MaxSnapshots
+}
+
+// RestoreSnapshot replaces the contents of a session's sandbox with a
+// snapshot. The snapshot is kept and can be restored again.
+func (s *SandboxManager) RestoreSnapshot(sessionID, name string) error {
+	entry, err := s.lockEntry(sessionID)
+	if err != nil {
+		return err
+	}
+	defer entry.ops.Unlock()
+	// Replacing the sandbox terminates its connections
+	defer s.markStickyDirty(sessionID)
+
+	s.mu.RLock()
+	snap, ok := findSnapshot(entry, name)
+	s.mu.RUnlock()
+	if !ok {
+		return ErrSnapshotNotFound
+	}
+
+	db := s.base
+
+	// Build the restored copy next to the sandbox, so a failed copy leaves
+	// the sandbox untouched
+	restoreName := entry.dbName + "_restore"
+	_ = s.dropDB(restoreName)
+	if _, err := db.Exec(fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s OWNER %s", restoreName, snap.dbName, s.config.AdminUser)); err != nil {
+		slog.Error("failed to copy snapshot", "snapshot", snap.dbName, "error", err)
+		return err
+	}
+
+	// Move the sandbox aside and drop it only once the copy took its
+	// place, so a failed rename can put it back
+	oldName := entry.dbName + "_old"
+	_ = s.dropDB(oldName)
+	if err := s.renameDB(db, entry.dbName, oldName); err != nil {
+		slog.Error("failed to move sandbox aside", "dbName", entry.dbName, "error", err)
+		_ = s.dropDB(restoreName)
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", restoreName, entry.dbName)); err != nil {
+		slog.Error("failed to rename restored sandbox", "dbName", entry.dbName, "error", err)
+		if err := s.renameDB(db, oldName, entry.dbName); err != nil {
+			slog.Error("failed to put back sandbox, session has no database", "dbName", entry.dbName, "error", err)
+		}
+		_ = s.dropDB(restoreName)
+		return err
+	}
+	_ = s.dropDB(oldName)
+
+	// Database level settings are not part of the copy
+	if err := s.claimDatabase(entry.dbName); err != nil {
+		return err
+	}
+	if err := s.grantSandboxPrivileges(entry.dbName); err != nil {
+		return err
+	}
+	limits := s.config.Limits
+	if ds, err := s.datasets.Get(entry.datasetID); err == nil {
+		limits = s.limitsFor(ds)
+	}
+	if err := s.applyLimits(entry.dbName, limits); err != nil {
+		return err
+	}
+
+	slog.Info("snapshot restored", "sessionID", sessionID, "snapshot", name, "dbName", entry.dbName)
+	return nil
+}
+
+// DeleteSnapshot drops a snapshot of a session
+func (s *SandboxManager) DeleteSnapshot(sessionID, name string) error {
+	entry, err := s.lockEntry(sessionID)
+	if err != nil {
+		return err
+	}
+	defer entry.ops.Unlock()
+
+	s.mu.RLock()
+	snap, ok := findSnapshot(entry, name)
+	s.mu.RUnlock()
+	if !ok {
+		return ErrSnapshotNotFound
+	}
+
+	if err := s.dropDB(snap.dbName); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for i, sn := range entry.snapshots {
+		if sn == snap {
+			entry.snapshots = append(entry.snapshots[:i], entry.snapshots[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	s.unregisterSnapshot(snap.dbName)
+
+	slog.Info("snapshot deleted", "sessionID", sessionID, "snapshot", name, "dbName", snap.dbName)
+	return nil
+}
+
+// lockEntry returns the entry of a session with its ops lock held, which
+// serializes snapshot operations on the sandbox
+func (s *SandboxManager) lockEntry(sessionID string) (*sandboxEntry, error) {
+	s.mu.RLock()
+	entry, ok := s.sandboxes[sessionID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	entry.ops.Lock()
+
+	// The sandbox may have been replaced while waiting for the lock
+	s.mu.RLock()
+	current := s.sandboxes[sessionID]
+	s.mu.RUnlock()
+	if current != entry {
+		entry.ops.Unlock()
+		return nil, ErrSessionNotFound
+	}
+	return entry, nil
+}
+
+// findSnapshot looks up a snapshot by name (s.mu must be held)
+func findSnapshot(entry *sandboxEntry, name string) (*Snapshot, bool) {
+	for _, snap := range entry.snapshots {
+		if snap.Name == name {
+			return snap, true
+		}
+	}
+	return nil, false
+}
+
+// copyDatabase clones src into dst. Cloning needs src without connections,
+// so new connections are refused and open ones terminated until the copy
+// is made.
+func (s *SandboxManager) copyDatabase(db *sql.DB, src, dst string) error {
+	s.evictConns(src)
+	if _, err := db.Exec(fmt.Sprintf(`ALTER DATABASE %s ALLOW_CONNECTIONS false`, src)); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := db.Exec(fmt.Sprintf(`ALTER DATABASE %s ALLOW_CONNECTIONS true`, src)); err != nil {
+			slog.Error("failed to reopen database after copy", "dbName", src, "error", err)
+		}
+	}()
+
+	_, err := db.Exec(`
+		SELECT pg_terminate_backend(pid)
+		FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()`, src)
+	if err != nil {
+		slog.Warn("failed to terminate connections", "dbName", src, "error", err)
+	}
+
+	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s OWNER %s", dst, src, s.config.AdminUser))
+	return err
+}
+
+// renameDB renames a database. Renaming needs it to have no connections,
+// so they are closed and new ones refused until it is done.
+func (s *SandboxManager) renameDB(db *sql.DB, from, to string) error {
+	s.evictConns(from)
+	if _, err := db.Exec(fmt.Sprintf(`ALTER DATABASE %s ALLOW_CONNECTIONS false`, from)); err != nil {
+		return err
+	}
+	name := from
+	defer func() {
+		if _, err := db.Exec(fmt.Sprintf(`ALTER DATABASE %s ALLOW_CONNECTIONS true`, name)); err != nil {
+			slog.Error("failed to reopen database after rename", "dbName", name, "error", err)
+		}
+	}()
+
+	_, err := db.Exec(`
+		SELECT pg_terminate_backend(pid)
+		FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()`, from)
+	if err != nil {
+		slog.Warn("failed to terminate connections", "dbName", from, "error", err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", from, to)); err != nil {
+		return err
+	}
+	name = to
+	return nil
+}
+
+// dropSnapshots drops every snapshot of a sandbox entry. They hold objects
+// owned by the sandbox role, so this must happen before the role is dropped.
+func (s *SandboxManager) dropSnapshots(entry *sandboxEntry) {
+	s.mu.Lock()
+	snaps := entry.snapshots
+	entry.snapshots = nil
+	s.mu.Unlock()
+
+	for _, snap := range snaps {
+		if err := s.dropDB(snap.dbName); err != nil {
+			slog.Warn("failed to drop snapshot", "dbName", snap.dbName, "error", err)
+			continue
+		}
+		s.unregisterSnapshot(snap.dbName)
+	}
+}
+
+// registerSnapshot records a snapshot in the registry
+func (s *SandboxManager) registerSnapshot(sessionID string, snap *Snapshot) {
+	if s.registry == nil {
+		return
+	}
+	_, err := s.registry.Exec(fmt.Sprintf(`
+		INSERT INTO %s (session_id, name, db_name, created_at)
+		VALUES ($1, $2, $3, $4)`, snapshotTable),
+		sessionID, snap.Name, snap.dbName, snap.CreatedAt)
+	if err != nil {
+		slog.Error("failed to register snapshot", "sessionID", sessionID, "dbName", snap.dbName, "error", err)
+	}
+}
+
+// unregisterSnapshot removes a snapshot from the registry
+func (s *SandboxManager) unregisterSnapshot(dbName string) {
+	if s.registry == nil {
+		return
+	}
+	if _, err := s.registry.Exec(fmt.Sprintf(`DELETE FROM %s WHERE db_name = $1`, snapshotTable), dbName); err != nil {
+		slog.Error("failed to unregister snapshot", "dbName", dbName, "error", err)
+	}
+}
+
+// loadSnapshots reads the registered snapshots of this instance's
+// sessions, keyed by session ID, forgetting those whose database is gone
+func (s *SandboxManager) loadSnapshots() (map[string][]*Snapshot, error) {
+	_, err := s.registry.Exec(fmt.Sprintf(`
+		DELETE FROM %s sn
+		USING %s r
+		WHERE r.session_id = sn.session_id AND r.instance_id = $1
+		  AND NOT EXISTS (SELECT 1 FROM pg_database d WHERE d.datname = sn.db_name)`,
+		snapshotTable, registryTable), s.config.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.registry.Query(fmt.Sprintf(`
+		SELECT sn.session_id, sn.name, sn.db_name, sn.created_at
+		FROM %s sn
+		JOIN %s r ON r.session_id = sn.session_id
+		WHERE r.instance_id = $1
+		ORDER BY sn.created_at`, snapshotTable, registryTable), s.config.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string][]*Snapshot)
+	for rows.Next() {
+		var sessionID string
+		snap := &Snapshot{}
+		if err := rows.Scan(&sessionID, &snap.Name, &snap.dbName, &snap.CreatedAt); err != nil {
+			return nil, err
+		}
+		out[sessionID] = append(out[sessionID], snap)
+	}
+	return out, rows.Err()
+}
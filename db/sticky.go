@@ -0,0 +1,301 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// In stateful mode a session keeps one connection to its sandbox across
+// requests, so transactions, SET, temp tables and prepared statements carry
+// over from one query to the next. Without it every request borrows a pooled
+// connection that is reset before it is used again.
+
+// Transaction status of a session connection after a request
+const (
+	TxIdle          = "idle"
+	TxInTransaction = "in transaction"
+	TxFailed        = "failed"
+)
+
+// stickyCleanupTimeout bounds the rollback when a sticky connection closes
+const stickyCleanupTimeout = 5 * time.Second
+
+// stickyConn is the dedicated connection of a session in stateful mode
+type stickyConn struct {
+	lock   chan struct{} // held while a request uses the connection
+	conn   *sql.Conn     // nil until the first request, or after a timeout
+	timer  *time.Timer   // closes the connection when idle, armed on release
+	closed bool          // the session left stateful mode
+
+	// dirty is set when the connection may have broken: the last request
+	// was cancelled, or the sandbox's connections were terminated. The
+	// next request checks the connection before using it.
+	dirty atomic.Bool
+}
+
+// SessionConn is a connection to a session's sandbox borrowed for one
+// request. Release must be called when the request is done.
+type SessionConn struct {
+	*sql.Conn
+	Stateful bool
+
+	release  func()
+	txStatus string
+	discard  bool
+}
+
+// SetStateful switches a session in or out of stateful mode. Leaving it
+// rolls back an open transaction and closes the session's connection, once
+// a request using it is done.
+func (s *SandboxManager) SetStateful(sessionID string, on bool) error {
+	if _, ok := s.GetDB(sessionID); !ok {
+		return ErrSessionNotFound
+	}
+
+	s.stickyMu.Lock()
+	sc, exists := s.sticky[sessionID]
+	switch {
+	case on && !exists:
+		s.sticky[sessionID] = &stickyConn{lock: make(chan struct{}, 1)}
+	case !on && exists:
+		delete(s.sticky, sessionID)
+	}
+	s.stickyMu.Unlock()
+
+	if !on && exists {
+		s.closeSticky(sessionID, sc)
+	}
+	return nil
+}
+
+// Stateful reports whether a session is in stateful mode
+func (s *SandboxManager) Stateful(sessionID string) bool {
+	s.stickyMu.Lock()
+	defer s.stickyMu.Unlock()
+	_, ok := s.sticky[sessionID]
+	return ok
+}
+
+// AcquireConn returns the connection a request of the session runs on: the
+// session's own connection in stateful mode, waiting until no other request
+// uses it, or a pooled one.
+func (s *SandboxManager) AcquireConn(ctx context.Context, sessionID string) (*SessionConn, error) {
+	s.stickyMu.Lock()
+	sc := s.sticky[sessionID]
+	s.stickyMu.Unlock()
+
+	if sc != nil {
+		select {
+		case sc.lock <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !sc.closed {
+			return s.acquireSticky(ctx, sessionID, sc)
+		}
+		// The session left stateful mode while we waited
+		<-sc.lock
+	}
+
+	conn, err := s.Conn(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	c := &SessionConn{Conn: conn}
+	c.release = func() {
+		if c.discard {
+			closeBad(conn)
+			return
+		}
+		// Roll back right away, so the connection holds no locks while
+		// it sits in the pool
+		if c.txStatus != TxIdle {
+			ctx, cancel := context.WithTimeout(context.Background(), stickyCleanupTimeout)
+			conn.ExecContext(ctx, "ROLLBACK")
+			cancel()
+		}
+		conn.Close()
+	}
+	return c, nil
+}
+
+// acquireSticky hands out the session's connection, opening a new one when
+// there is none or the old one died, e.g. because the sandbox was copied
+// (sc.lock must be held)
+func (s *SandboxManager) acquireSticky(ctx context.Context, sessionID string, sc *stickyConn) (*SessionConn, error) {
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+
+	if sc.dirty.Swap(false) && sc.conn != nil && sc.conn.PingContext(ctx) != nil {
+		slog.Info("session connection lost, opening a new one", "sessionID", sessionID)
+		sc.conn.Close()
+		sc.conn = nil
+	}
+
+	if sc.conn == nil {
+		conn, err := s.Conn(ctx, sessionID)
+		if err != nil {
+			<-sc.lock
+			return nil, err
+		}
+		sc.conn = conn
+	}
+
+	c := &SessionConn{Conn: sc.conn, Stateful: true}
+	c.release = func() {
+		// A statement that failed with a driver error leaves the connection
+		// broken; one cut short by the client going away may have. A
+		// transaction left open may be ended by the idle timeout, which
+		// closes the connection.
+		if c.discard || !connValid(sc.conn) {
+			closeBad(sc.conn)
+			sc.conn = nil
+		} else if ctx.Err() != nil || c.txStatus != TxIdle {
+			sc.dirty.Store(true)
+		}
+		if sc.timer == nil {
+			sc.timer = time.AfterFunc(s.config.StatefulIdleTimeout, func() { s.expireSticky(sessionID, sc) })
+		} else {
+			sc.timer.Reset(s.config.StatefulIdleTimeout)
+		}
+		<-sc.lock
+	}
+	return c, nil
+}
+
+// TxStatus reports whether the connection is idle, inside a transaction or
+// inside a failed transaction. It returns an empty string if the status
+// can't be read. It runs even when ctx is cancelled, since the status
+// decides how the connection is cleaned up.
+func (c *SessionConn) TxStatus(ctx context.Context) string {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stickyCleanupTimeout)
+	defer cancel()
+
+	// Outside a transaction block every statement is its own transaction,
+	// so the transaction started with this statement
+	var inTx bool
+	err := c.QueryRowContext(ctx, `SELECT now() <> statement_timestamp()`).Scan(&inTx)
+
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr) && pqErr.Code == "25P02": // in_failed_sql_transaction
+		c.txStatus = TxFailed
+	case err != nil:
+		c.txStatus = ""
+	case inTx:
+		c.txStatus = TxInTransaction
+	default:
+		c.txStatus = TxIdle
+	}
+	return c.txStatus
+}
+
+// Discard makes Release close the connection instead of handing it back,
+// for a connection left in a state that must not be reused, e.g. holding
+// changes that should have been rolled back
+func (c *SessionConn) Discard() {
+	c.discard = true
+}
+
+// Release gives the connection back. A pooled connection is rolled back
+// unless TxStatus found it idle; the session's own connection keeps its
+// transaction and is closed after being idle for too long.
+func (c *SessionConn) Release() {
+	c.release()
+}
+
+// expireSticky closes the connection of a session idle for too long. The
+// session stays in stateful mode and gets a new connection on its next
+// request.
+func (s *SandboxManager) expireSticky(sessionID string, sc *stickyConn) {
+	select {
+	case sc.lock <- struct{}{}:
+	default:
+		return // in use, released with a new timer
+	}
+	defer func() { <-sc.lock }()
+
+	if sc.conn != nil {
+		slog.Info("closing idle session connection", "sessionID", sessionID)
+		rollbackAndClose(sc.conn)
+		sc.conn = nil
+	}
+}
+
+// closeSticky closes the connection of a session leaving stateful mode
+func (s *SandboxManager) closeSticky(sessionID string, sc *stickyConn) {
+	sc.lock <- struct{}{}
+	defer func() { <-sc.lock }()
+
+	sc.closed = true
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+	if sc.conn != nil {
+		slog.Info("closing session connection", "sessionID", sessionID)
+		rollbackAndClose(sc.conn)
+		sc.conn = nil
+	}
+}
+
+// dropSticky ends stateful mode for a session that is going away
+func (s *SandboxManager) dropSticky(sessionID string) {
+	s.stickyMu.Lock()
+	sc, ok := s.sticky[sessionID]
+	delete(s.sticky, sessionID)
+	s.stickyMu.Unlock()
+
+	if ok {
+		s.closeSticky(sessionID, sc)
+	}
+}
+
+// markStickyDirty makes the next request of a stateful session check its
+// connection first, e.g. after the connections to its sandbox were
+// terminated for a copy
+func (s *SandboxManager) markStickyDirty(sessionID string) {
+	s.stickyMu.Lock()
+	sc := s.sticky[sessionID]
+	s.stickyMu.Unlock()
+
+	if sc != nil {
+		sc.dirty.Store(true)
+	}
+}
+
+// rollbackAndClose ends an open transaction before the connection goes
+// back to the pool, which resets it before reuse
+func rollbackAndClose(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), stickyCleanupTimeout)
+	defer cancel()
+	conn.ExecContext(ctx, "ROLLBACK")
+	conn.Close()
+}
+
+// closeBad closes a connection without returning it to its pool, which
+// ends its session and with it any open transaction
+func closeBad(conn *sql.Conn) {
+	conn.Raw(func(any) error { return driver.ErrBadConn })
+	conn.Close()
+}
+
+// connValid reports whether the driver still considers a connection usable.
+// A request cancelled mid-statement leaves it broken.
+func connValid(conn *sql.Conn) bool {
+	valid := true
+	conn.Raw(func(dc any) error {
+		if v, ok := dc.(driver.Validator); ok {
+			valid = v.IsValid()
+		}
+		return nil
+	})
+	return valid
+}
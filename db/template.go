@@ -0,0 +1,297 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// templatePrefix is the name prefix of prepared template databases,
+// followed by the instance ID. The rest of the name is derived from the
+// dataset ID and the init SQL checksum, so a template that already exists
+// with the right name is up to date.
+const templatePrefix = "querylab_template_"
+
+// templateLabelLen caps the dataset ID shown in template names, which
+// have to fit PostgreSQL's 63 byte identifiers with the "_build" suffix
+const templateLabelLen = 8
+
+// templateState tracks the prepared template database of one dataset
+type templateState struct {
+	// mu is held for writing while the template is (re)built or dropped,
+	// and for reading while a sandbox is cloned from it
+	mu sync.RWMutex
+
+	datasetID string
+	path      string
+	name      string
+	checksum  string
+
+	// file info from the last checksum, used to skip re-hashing unchanged files
+	modTime time.Time
+	size    int64
+}
+
+// templateFor returns the template state of a dataset. Datasets never
+// share a template, even when their SQL is the same, so refreshing one
+// can't drop the template another is cloned from.
+func (s *SandboxManager) templateFor(ds *Dataset) *templateState {
+	s.tplMu.Lock()
+	defer s.tplMu.Unlock()
+
+	tpl, ok := s.templates[ds.ID]
+	if !ok {
+		tpl = &templateState{datasetID: ds.ID, path: ds.Path}
+		s.templates[ds.ID] = tpl
+	}
+	return tpl
+}
+
+// templateName names the template of a dataset. The ID is shortened to a
+// readable label; the hash over the full ID and the checksum keeps the
+// names of datasets apart whose labels or SQL are the same.
+func (s *SandboxManager) templateName(datasetID, checksum string) string {
+	sum := sha256.Sum256([]byte(datasetID + "\x00" + checksum))
+	return s.instanceTemplatePrefix() + identLabel(datasetID, templateLabelLen) + "_" + hex.EncodeToString(sum[:6])
+}
+
+// identLabel turns s into at most n characters that are safe in an
+// unquoted identifier
+func identLabel(s string, n int) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if b.Len() == n {
+			break
+		}
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// upToDate reports whether the template was built from the file as it is
+// now (mu must be held)
+func (tpl *templateState) upToDate(info os.FileInfo) bool {
+	return tpl.name != "" && info.ModTime().Equal(tpl.modTime) && info.Size() == tpl.size
+}
+
+// prepareTemplates builds the template for every dataset at startup
+// and drops templates left over from older versions of the files
+func (s *SandboxManager) prepareTemplates() {
+	for _, ds := range s.datasets.List() {
+		tpl := s.templateFor(&ds)
+		if err := s.refreshTemplate(tpl); err != nil {
+			slog.Warn("failed to prepare template database, sandboxes will run init SQL directly",
+				"dataset", ds.ID,
+				"file", ds.Path,
+				"error", err,
+			)
+		}
+	}
+
+	if err := s.dropStaleTemplates(); err != nil {
+		slog.Warn("failed to drop stale template databases", "error", err)
+	}
+}
+
+// refreshTemplate makes sure the template matches the current contents of
+// its SQL file, rebuilding it when the file checksum has changed
+func (s *SandboxManager) refreshTemplate(tpl *templateState) error {
+	info, err := os.Stat(tpl.path)
+	if err != nil {
+		return err
+	}
+
+	tpl.mu.Lock()
+	defer tpl.mu.Unlock()
+
+	if tpl.upToDate(info) {
+		return nil
+	}
+
+	sqlBytes, err := os.ReadFile(tpl.path)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(sqlBytes)
+	checksum := hex.EncodeToString(sum[:])
+
+	if checksum == tpl.checksum && tpl.name != "" {
+		tpl.modTime, tpl.size = info.ModTime(), info.Size()
+		return nil
+	}
+
+	name := s.templateName(tpl.datasetID, checksum)
+	exists, err := s.databaseExists(name)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		slog.Info("building template database", "file", tpl.path, "dbName", name)
+		start := time.Now()
+		if err := s.buildTemplate(name, string(sqlBytes)); err != nil {
+			return err
+		}
+		slog.Info("template database ready", "dbName", name, "duration", time.Since(start))
+	}
+
+	old := tpl.name
+	tpl.name = name
+	tpl.checksum = checksum
+	// Only a successful build records the file, a failed one is retried
+	tpl.modTime, tpl.size = info.ModTime(), info.Size()
+
+	if old != "" && old != name {
+		if err := s.dropTemplate(old); err != nil {
+			slog.Warn("failed to drop outdated template", "dbName", old, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// buildTemplate creates the template under a temporary name and renames it
+// once the init SQL succeeded, so a half-built template is never reused
+func (s *SandboxManager) buildTemplate(name, initSQL string) error {
+	buildName := name + "_build"
+	_ = s.dropTemplate(buildName)
+
+	if err := s.createDB(buildName); err != nil {
+		return err
+	}
+
+	db, err := s.adminDB(buildName)
+	if err != nil {
+		_ = s.dropDB(buildName)
+		return err
+	}
+
+	_, err = db.Exec(initSQL)
+	// Renaming and cloning the template need it to have no connections
+	s.evictConns(buildName)
+	if err != nil {
+		_ = s.dropDB(buildName)
+		return fmt.Errorf("init SQL failed on template: %w", err)
+	}
+
+	stmts := []string{
+		fmt.Sprintf(`ALTER DATABASE %s RENAME TO %s`, buildName, name),
+		// Nobody may connect to the template, otherwise cloning it fails
+		fmt.Sprintf(`ALTER DATABASE %s ALLOW_CONNECTIONS false`, name),
+		fmt.Sprintf(`COMMENT ON DATABASE %s IS %s`, name, pq.QuoteLiteral(s.ownerComment())),
+	}
+	for _, stmt := range stmts {
+		if _, err := s.base.Exec(stmt); err != nil {
+			slog.Error("template finalize error", "statement", stmt, "error", err)
+			_ = s.dropDB(buildName)
+			_ = s.dropDB(name)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropTemplate drops a template database
+func (s *SandboxManager) dropTemplate(name string) error {
+	return s.dropDB(name)
+}
+
+// dropStaleTemplates drops every template database of this instance that
+// is not in use
+func (s *SandboxManager) dropStaleTemplates() error {
+	db := s.base
+
+	names, err := s.ownedDatabaseNames(db, s.instanceTemplatePrefix())
+	if err != nil {
+		return err
+	}
+
+	inUse := make(map[string]bool)
+	s.tplMu.Lock()
+	for _, tpl := range s.templates {
+		tpl.mu.RLock()
+		inUse[tpl.name] = true
+		tpl.mu.RUnlock()
+	}
+	s.tplMu.Unlock()
+
+	var stale []string
+	for _, name := range names {
+		if !inUse[name] {
+			stale = append(stale, name)
+		}
+	}
+
+	for _, name := range stale {
+		slog.Info("dropping stale template database", "dbName", name)
+		if err := s.dropTemplate(name); err != nil {
+			slog.Warn("failed to drop stale template", "dbName", name, "error", err)
+		}
+	}
+	return nil
+}
+
+// currentTemplate returns the name of the up-to-date template of a
+// dataset, or an empty string if it can't be built
+func (s *SandboxManager) currentTemplate(ds *Dataset) string {
+	tpl := s.templateFor(ds)
+	if err := s.refreshTemplate(tpl); err != nil {
+		return ""
+	}
+
+	tpl.mu.RLock()
+	defer tpl.mu.RUnlock()
+	return tpl.name
+}
+
+// cloneFromTemplate creates a sandbox database as a copy of the template
+// of a dataset, rebuilding the template first if the file changed.
+// It returns the name of the template used.
+func (s *SandboxManager) cloneFromTemplate(dbName string, ds *Dataset) (string, error) {
+	tpl := s.templateFor(ds)
+	for {
+		info, err := os.Stat(tpl.path)
+		if err != nil {
+			return "", err
+		}
+
+		// The read lock is held from the check through the copy, so the
+		// template can't be rebuilt or dropped in between
+		tpl.mu.RLock()
+		if tpl.upToDate(info) {
+			_, err := s.base.Exec(fmt.Sprintf(
+				"CREATE DATABASE %s TEMPLATE %s OWNER %s",
+				dbName,
+				tpl.name,
+				s.config.AdminUser,
+			))
+			name := tpl.name
+			tpl.mu.RUnlock()
+			return name, err
+		}
+		tpl.mu.RUnlock()
+
+		if err := s.refreshTemplate(tpl); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (s *SandboxManager) databaseExists(name string) (bool, error) {
+	var exists bool
+	err := s.base.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, name).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestIdentLabel(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"default", 8, "default"},
+		{"library", 8, "library"},
+		{"Company-HR", 8, "company_"},
+		{"a b.c", 8, "a_b_c"},
+		{"ünï", 8, "_n_"},
+		{"longer_than_eight", 8, "longer_t"},
+		{"", 8, ""},
+	}
+
+	for _, tt := range tests {
+		if got := identLabel(tt.in, tt.n); got != tt.want {
+			t.Errorf("identLabel(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateName(t *testing.T) {
+	s := &SandboxManager{config: &DBConfig{InstanceID: strings.Repeat("x", 16)}}
+	checksum := strings.Repeat("ab", 32)
+	unquoted := regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+	names := make(map[string]string)
+	for _, id := range []string{"default", "library", "Library", "library!", "a_very_long_dataset_name", "a_very_long_dataset_name_2"} {
+		name := s.templateName(id, checksum)
+		if !unquoted.MatchString(name) {
+			t.Errorf("templateName(%q) = %q, not a plain identifier", id, name)
+		}
+		if len(name+"_build") > 63 {
+			t.Errorf("templateName(%q) = %q, too long to build under", id, name)
+		}
+		if other, ok := names[name]; ok {
+			t.Errorf("datasets %q and %q share the template %q", other, id, name)
+		}
+		names[name] = id
+	}
+
+	if s.templateName("default", checksum) != s.templateName("default", checksum) {
+		t.Error("templateName is not stable")
+	}
+	if s.templateName("default", checksum) == s.templateName("default", strings.Repeat("cd", 32)) {
+		t.Error("templateName ignores the checksum")
+	}
+}
@@ -1,15 +1,24 @@
 -- This file is executed by Postgres on first startup
 
--- Create admin role
+-- Create admin role. It creates a sandbox database and a login role for
+-- every session, so it needs CREATEDB and CREATEROLE.
 CREATE ROLE querylab_admin LOGIN;
-ALTER ROLE querylab_admin CREATEDB;
-
--- Create sandbox role
-CREATE ROLE querylab_sandbox LOGIN;
-ALTER ROLE querylab_sandbox
-    NOSUPERUSER
-    NOCREATEDB
-    NOCREATEROLE
-    NOINHERIT
-    NOREPLICATION
-    CONNECTION LIMIT 50;
+ALTER ROLE querylab_admin CREATEDB CREATEROLE;
+
+-- Let the admin put temp_file_limit on sandbox databases
+GRANT SET ON PARAMETER temp_file_limit TO querylab_admin;
+
+-- Let the admin close sandbox connections before dropping or copying a
+-- sandbox database
+GRANT pg_signal_backend TO querylab_admin;
+
+-- Sandbox roles may only connect to their own database, which grants
+-- CONNECT to them explicitly. Keep them out of the shared databases.
+REVOKE CONNECT, TEMP ON DATABASE postgres FROM PUBLIC;
+GRANT CONNECT ON DATABASE postgres TO querylab_admin;
+DO $$
+BEGIN
+    EXECUTE format('REVOKE CONNECT, TEMP ON DATABASE %I FROM PUBLIC', current_database());
+    EXECUTE format('GRANT CONNECT, TEMP ON DATABASE %I TO querylab_admin', current_database());
+END
+$$;
@@ -1,28 +1,87 @@
 const QueryLabApp = {
     sessionID: null,
+    queryID: null,
+    dataset: null,
+    datasets: [],
     isLoading: false,
     popupTimeout: null,
     progressInterval: null,
 
     async init() {
         console.log('QueryLab app initializing...');
-        await this.initializeSession();
+        await this.loadDatasets();
+        await this.initializeSession('', this.takeForkToken());
         this.setupEventListeners();
         this.setupUnloadHandler();
     },
 
-    async initializeSession() {
+    async loadDatasets() {
+        const select = document.getElementById('datasetSelect');
+        if (!select) return;
+
+        try {
+            const response = await fetch('/api/datasets');
+            if (!response.ok) throw new Error(`HTTP ${response.status}`);
+
+            this.datasets = await response.json();
+            select.innerHTML = this.datasets.map(ds =>
+                `<option value="${this.escapeHtml(ds.id)}">${this.escapeHtml(ds.name)}${ds.difficulty ? ` (${this.escapeHtml(ds.difficulty)})` : ''}</option>`
+            ).join('');
+        } catch (error) {
+            console.error('Failed to load datasets:', error);
+        }
+    },
+
+    showDataset(id) {
+        const select = document.getElementById('datasetSelect');
+        if (!select) return;
+
+        select.value = id;
+        const ds = this.datasets.find(d => d.id === id);
+        document.getElementById('datasetDescription').textContent = ds && ds.description ? ds.description : '';
+    },
+
+    // takeForkToken returns the fork token of a shared link and removes it
+    // from the address bar, so a refresh doesn't redeem it again
+    takeForkToken() {
+        const params = new URLSearchParams(window.location.search);
+        const fork = params.get('fork') || '';
+        if (fork) {
+            params.delete('fork');
+            const query = params.toString();
+            history.replaceState(null, '', window.location.pathname + (query ? `?${query}` : ''));
+        }
+        return fork;
+    },
+
+    async initializeSession(dataset = '', fork = '') {
         try {
             this.setLoading(true);
 
-            const response = await fetch('/api/session', { method: 'POST', headers: { 'Content-Type': 'application/json' }});
+            let response = await fetch('/api/session', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ dataset, fork })
+            });
+            if (fork && response.status === 404) {
+                this.showPopup('This shared link has expired, starting a fresh session', 'warning');
+                response = await fetch('/api/session', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ dataset })
+                });
+            }
             if (!response.ok) throw new Error(`HTTP ${response.status}`);
 
             const data = await response.json();
             this.sessionID = data.session_id;
+            this.dataset = data.dataset;
+            this.showStateful(data.stateful);
+            this.showDataset(this.dataset);
 
             console.log('Session initialized:', this.sessionID);
             this.showPopup('Session ready', 'success');
+            this.loadSnapshots();
 
         } catch (error) {
             console.error('Failed to initialize session:', error);
@@ -45,64 +104,345 @@ const QueryLabApp = {
         }
 
         try {
+            this.queryID = this.newQueryID();
             this.setLoading(true);
             this.clearResults();
 
             const response = await fetch('/api/query', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({ query, session_id: this.sessionID })
+                body: JSON.stringify({ query, query_id: this.queryID, session_id: this.sessionID })
             });
 
             if (!response.ok) throw new Error(`HTTP ${response.status}`);
 
             const data = await response.json();
+            this.displayResults(data);
 
             if (data.error) {
-                this.showPopup(`Error: ${data.error}`, 'error');
+                this.showPopup(`Error: ${this.escapeHtml(data.error)}`, 'error');
                 return;
             }
 
-            this.displayResults(data);
             this.showPopup(`Query executed successfully`, 'success');
 
         } catch (error) {
             console.error('Query execution failed:', error);
             this.showPopup('Query failed to execute', 'error');
         } finally {
+            this.queryID = null;
             this.setLoading(false);
         }
     },
 
-    displayResults(data) {
+    async explainQuery() {
+        const query = document.getElementById('query').value.trim();
+        if (!query) {
+            this.showPopup('Please enter a SQL query', 'warning');
+            return;
+        }
+
+        if (!this.sessionID) {
+            await this.initializeSession();
+            if (!this.sessionID) return;
+        }
+
+        const analyze = document.getElementById('explainAnalyze').checked;
+        try {
+            this.queryID = this.newQueryID();
+            this.setLoading(true);
+            this.clearResults();
+
+            const response = await fetch('/api/explain', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ query, analyze, buffers: analyze, query_id: this.queryID })
+            });
+            if (response.status === 400) {
+                this.showPopup(this.escapeHtml(await response.text()), 'warning');
+                return;
+            }
+            if (!response.ok) throw new Error(`HTTP ${response.status}`);
+
+            const data = await response.json();
+            this.displayPlan(data);
+        } catch (error) {
+            console.error('Explain failed:', error);
+            this.showPopup('Failed to explain the query', 'error');
+        } finally {
+            this.queryID = null;
+            this.setLoading(false);
+        }
+    },
+
+    displayPlan(data) {
         const resultDiv = document.getElementById('result');
-        if (!data.rows || data.rows.length === 0) {
-            resultDiv.innerHTML = '<p>Query executed successfully. No rows returned.</p>';
+        this.showTxStatus(data.stateful ? data.transaction_status : '');
+
+        let html = '<div class="statement-result">' + this.renderNotices(data.notices);
+        if (data.error) {
+            resultDiv.innerHTML = html + this.renderError(data) + '</div>';
+            if (data.error_detail && data.error_detail.line) this.highlightError(data.error_detail);
+            this.showPopup(`Error: ${this.escapeHtml(data.error)}`, 'error');
             return;
         }
 
-        let html = `
+        const info = [];
+        if (data.planning_ms !== undefined) info.push(`planning ${data.planning_ms} ms`);
+        if (data.execution_ms !== undefined) info.push(`execution ${data.execution_ms} ms`);
+        if (data.analyze) info.push('changes were rolled back');
+        if (info.length) html += `<div class="result-info"><p>${info.join(' &middot; ')}</p></div>`;
+        html += `<pre class="plan-text">${this.escapeHtml(data.text)}</pre></div>`;
+        resultDiv.innerHTML = html;
+    },
+
+    newQueryID() {
+        const bytes = new Uint8Array(8);
+        crypto.getRandomValues(bytes);
+        return Array.from(bytes, b => b.toString(16).padStart(2, '0')).join('');
+    },
+
+    async cancelQuery() {
+        if (!this.queryID) return;
+
+        try {
+            const response = await fetch('/api/query/cancel', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ query_id: this.queryID })
+            });
+            if (!response.ok) throw new Error(`HTTP ${response.status}`);
+            this.showPopup('Cancelling query...', 'info');
+        } catch (error) {
+            console.error('Query cancellation failed:', error);
+            this.showPopup('Failed to cancel query', 'error');
+        }
+    },
+
+    displayResults(data) {
+        const resultDiv = document.getElementById('result');
+        const results = data.results && data.results.length ? data.results : [data];
+        resultDiv.innerHTML = results.map(res => this.renderResult(res, results.length > 1)).join('');
+        this.showTxStatus(data.stateful ? data.transaction_status : '');
+
+        const failed = results.find(res => res.error_detail && res.error_detail.line);
+        if (failed) this.highlightError(failed.error_detail);
+    },
+
+    // Plain-language notes for the errors learners run into most
+    errorExplanations: {
+        '42601': 'The query has a syntax error near the highlighted spot, often a missing comma, quote or keyword.',
+        '42703': 'A column with this name does not exist in the tables of the query. Check the spelling and the table it belongs to.',
+        '42P01': 'The table does not exist. Check the spelling, or look it up with "Show Schema".',
+        '42803': 'Every selected column must either appear in GROUP BY or be used in an aggregate function.',
+        '23505': 'Another row already has this value in a column that must be unique.',
+        '23503': 'The row refers to a row in another table that does not exist, or is still referred to by another row.',
+        '23502': 'A column that must have a value was left empty (NULL).',
+        '22P02': 'A value has the wrong format for its column type, e.g. text where a number is expected.',
+        '22012': 'The query divides by zero.',
+        '25P02': 'An earlier statement in this transaction failed. Run ROLLBACK to start over.',
+        '57014': 'The query was cancelled or ran longer than the time limit.'
+    },
+
+    renderError(res) {
+        const detail = res.error_detail;
+        if (!detail) {
+            return `<p class="statement-error">Error: ${this.escapeHtml(res.error)}</p>`;
+        }
+
+        let html = `<p class="statement-error">Error: ${this.escapeHtml(detail.message)}`;
+        if (detail.code) html += ` <span class="error-code">${this.escapeHtml(detail.code)} ${this.escapeHtml(detail.code_name || '')}</span>`;
+        html += '</p>';
+        if (detail.line) html += `<p class="error-extra">At line ${detail.line}, column ${detail.column}</p>`;
+        if (detail.detail) html += `<p class="error-extra">Detail: ${this.escapeHtml(detail.detail)}</p>`;
+        if (detail.hint) html += `<p class="error-extra">Hint: ${this.escapeHtml(detail.hint)}</p>`;
+        const explanation = this.errorExplanations[detail.code];
+        if (explanation) html += `<p class="error-explanation"><i class="fas fa-info-circle"></i> ${explanation}</p>`;
+        return html;
+    },
+
+    // renderNotices lists the NOTICE and WARNING messages of a statement
+    renderNotices(notices) {
+        if (!notices || !notices.length) return '';
+
+        return '<ul class="notice-list">' + notices.map(n => {
+            const severity = (n.severity || 'NOTICE').toUpperCase();
+            let html = `<li class="notice notice-${this.escapeHtml(severity.toLowerCase())}"><strong>${this.escapeHtml(severity)}:</strong> ${this.escapeHtml(n.message)}`;
+            if (n.detail) html += `<br><span class="error-extra">Detail: ${this.escapeHtml(n.detail)}</span>`;
+            if (n.hint) html += `<br><span class="error-extra">Hint: ${this.escapeHtml(n.hint)}</span>`;
+            return html + '</li>';
+        }).join('') + '</ul>';
+    },
+
+    // highlightError selects the character the error points at in the editor
+    highlightError(detail) {
+        const textarea = document.getElementById('query');
+        const lines = textarea.value.split('\n');
+        if (detail.line > lines.length) return;
+
+        let offset = 0;
+        for (let i = 0; i < detail.line - 1; i++) offset += lines[i].length + 1;
+        // Columns count characters, the textarea counts UTF-16 units
+        const chars = Array.from(lines[detail.line - 1]);
+        offset += chars.slice(0, detail.column - 1).join('').length;
+        const width = (chars[detail.column - 1] || ' ').length;
+
+        textarea.focus();
+        textarea.setSelectionRange(offset, offset + width);
+    },
+
+    showStateful(enabled) {
+        const toggle = document.getElementById('statefulToggle');
+        if (toggle) toggle.checked = !!enabled;
+        if (!enabled) this.showTxStatus('');
+    },
+
+    showTxStatus(status) {
+        const badge = document.getElementById('txStatus');
+        if (!badge) return;
+
+        badge.textContent = status ? `Transaction: ${status}` : '';
+        badge.className = `tx-status ${status === 'failed' ? 'tx-failed' : status === 'in transaction' ? 'tx-open' : ''}`;
+    },
+
+    async setStateful(enabled) {
+        try {
+            const response = await fetch('/api/session/stateful', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ enabled })
+            });
+            if (!response.ok) throw new Error(`HTTP ${response.status}`);
+
+            const data = await response.json();
+            this.showStateful(data.enabled);
+            this.showPopup(data.enabled ? 'Session state now carries over between queries' : 'Each query now starts fresh', 'info');
+        } catch (error) {
+            console.error('Failed to switch stateful mode:', error);
+            this.showPopup('Failed to switch stateful mode', 'error');
+            this.showStateful(!enabled);
+        }
+    },
+
+    renderResult(res, showStatement) {
+        let html = '<div class="statement-result">';
+        if (showStatement && res.statement) {
+            html += `<pre class="statement-sql">${this.escapeHtml(res.statement)}</pre>`;
+        }
+        html += this.renderNotices(res.notices);
+
+        if (res.error) {
+            return html + this.renderError(res) + '</div>';
+        }
+
+        const rows = res.rows || [];
+        const columns = res.columns || [];
+        const info = [];
+        if (res.command_tag) info.push(this.escapeHtml(res.command_tag));
+        if (columns.length) info.push(`${rows.length} row${rows.length !== 1 ? 's' : ''} returned`);
+        if (res.duration_ms !== undefined) info.push(`${res.duration_ms} ms`);
+        if (res.truncated) {
+            const limit = res.limit_type === 'bytes' ? `${res.limit} byte` : `${res.limit} row`;
+            info.push(`<span class="truncated">truncated at the ${limit} limit</span>`);
+        }
+
+        if (columns.length === 0) {
+            if (res.statement_type === 'dml') {
+                return html + `<p><strong>${this.escapeHtml(res.command_tag || '')}</strong> &middot; ${res.rows_affected} row${res.rows_affected !== 1 ? 's' : ''} affected &middot; ${res.duration_ms} ms</p></div>`;
+            }
+            if (res.command_tag) {
+                return html + `<p><strong>${this.escapeHtml(res.command_tag)}</strong> &middot; ${res.duration_ms} ms</p></div>`;
+            }
+            return html + `<p>Query executed successfully. No rows returned.</p></div>`;
+        }
+
+        html += `
             <div class="result-info">
-                <p>${data.rows.length} row${data.rows.length !== 1 ? 's' : ''} returned</p>
+                <p>${info.join(' &middot; ')}</p>
             </div>
             <div class="table-container">
                 <table>
                     <thead>
-                        <tr>${data.columns.map(col => `<th>${this.escapeHtml(col)}</th>`).join('')}</tr>
+                        <tr>${columns.map(col => this.renderColumnHeader(col)).join('')}</tr>
                     </thead>
                     <tbody>
         `;
 
-        data.rows.forEach(row => {
+        rows.forEach(row => {
             html += '<tr>';
             row.forEach(cell => {
-                html += `<td>${this.escapeHtml(cell === null ? 'NULL' : cell.toString())}</td>`;
+                html += `<td>${this.escapeHtml(this.formatCell(cell))}</td>`;
             });
             html += '</tr>';
         });
 
-        html += `</tbody></table></div>`;
-        resultDiv.innerHTML = html;
+        html += `</tbody></table></div></div>`;
+        return html;
+    },
+
+    renderColumnHeader(col) {
+        if (typeof col === 'string') return `<th>${this.escapeHtml(col)}</th>`;
+
+        let type = (col.type || '').toLowerCase();
+        if (type.startsWith('_')) type = type.slice(1) + '[]';
+        if (col.precision !== undefined) type += `(${col.precision},${col.scale})`;
+        else if (col.length !== undefined) type += `(${col.length})`;
+
+        return `<th title="${this.escapeHtml(type)}">${this.escapeHtml(col.name)}<span class="col-type">${this.escapeHtml(type)}</span></th>`;
+    },
+
+    formatCell(cell) {
+        if (cell === null) return 'NULL';
+        if (typeof cell === 'object') return JSON.stringify(cell);
+        return cell.toString();
+    },
+
+    async loadSchema() {
+        const section = document.getElementById('schemaSection');
+        if (!section) return;
+
+        try {
+            const response = await fetch('/api/schema');
+            if (!response.ok) throw new Error(`HTTP ${response.status}`);
+
+            const schema = await response.json();
+            this.displaySchema(schema);
+            document.getElementById('schemaDiagram').src = `/api/schema/erd?format=svg&t=${Date.now()}`;
+            section.style.display = 'block';
+        } catch (error) {
+            console.error('Failed to load schema:', error);
+            this.showPopup('Failed to load schema', 'error');
+        }
+    },
+
+    displaySchema(schema) {
+        const schemaDiv = document.getElementById('schema');
+        if (!schema.tables.length) {
+            schemaDiv.innerHTML = '<p>No tables in this database.</p>';
+            return;
+        }
+
+        schemaDiv.innerHTML = schema.tables.map(table => {
+            const fks = {};
+            table.foreign_keys.forEach(fk => fk.columns.forEach((col, i) => {
+                fks[col] = `${fk.ref_table}.${fk.ref_columns[i]}`;
+            }));
+
+            const columns = table.columns.map(col => {
+                const pk = table.primary_key.includes(col.name) ? ' <i class="fas fa-key" title="Primary key"></i>' : '';
+                const fk = fks[col.name] ? ` <span class="schema-fk">&rarr; ${this.escapeHtml(fks[col.name])}</span>` : '';
+                const nullable = col.nullable ? '' : ' NOT NULL';
+                return `<li><code>${this.escapeHtml(col.name)}</code> ${this.escapeHtml(col.type)}${nullable}${pk}${fk}</li>`;
+            }).join('');
+
+            const count = table.row_count === null ? '?' : table.row_count;
+            return `
+                <div class="schema-table">
+                    <h3>${this.escapeHtml(table.name)} <span class="schema-count">${count} row${count !== 1 ? 's' : ''}</span></h3>
+                    <ul>${columns}</ul>
+                </div>
+            `;
+        }).join('');
     },
 
     async logout() {
@@ -120,19 +460,174 @@ const QueryLabApp = {
             this.clearResults();
             this.showPopup('Session cleared', 'success');
 
-            await this.initializeSession();
+            await this.initializeSession(this.dataset || '');
         } catch (error) {
             console.error('Logout failed:', error);
             this.showPopup('Failed to clear session', 'error');
         }
     },
 
+    async resetSession() {
+        if (!this.sessionID) return;
+        if (!confirm('Reset the database to its original data? Your changes will be lost.')) return;
+
+        try {
+            this.setLoading(true);
+            const response = await fetch('/api/session/reset', { method: 'POST' });
+            if (!response.ok) throw new Error(`HTTP ${response.status}`);
+
+            this.clearResults();
+            this.showPopup('Database reset', 'success');
+            this.loadSnapshots();
+        } catch (error) {
+            console.error('Reset failed:', error);
+            this.showPopup('Failed to reset database', 'error');
+        } finally {
+            this.setLoading(false);
+        }
+    },
+
+    async loadSnapshots() {
+        const list = document.getElementById('snapshotList');
+        if (!list) return;
+
+        try {
+            const response = await fetch('/api/snapshots');
+            if (!response.ok) throw new Error(`HTTP ${response.status}`);
+            this.renderSnapshots(await response.json());
+        } catch (error) {
+            console.error('Failed to load snapshots:', error);
+        }
+    },
+
+    renderSnapshots(data) {
+        const list = document.getElementById('snapshotList');
+        document.getElementById('snapshotQuota').textContent = `${data.snapshots.length} / ${data.max}`;
+
+        if (data.snapshots.length === 0) {
+            list.innerHTML = '<li class="snapshot-empty">No snapshots yet</li>';
+            return;
+        }
+        list.innerHTML = data.snapshots.map(snap => `
+            <li>
+                <span class="snapshot-name">${this.escapeHtml(snap.name)}</span>
+                <span class="snapshot-time">${new Date(snap.created_at).toLocaleTimeString()}</span>
+                <button class="btn-secondary" data-restore="${this.escapeHtml(snap.name)}"><i class="fas fa-history"></i> Restore</button>
+                <button class="btn-danger" data-delete="${this.escapeHtml(snap.name)}"><i class="fas fa-trash"></i></button>
+            </li>
+        `).join('');
+    },
+
+    async snapshotRequest(url, options, success) {
+        try {
+            this.setLoading(true);
+            const response = await fetch(url, options);
+            if (!response.ok) throw new Error((await response.text()).trim() || `HTTP ${response.status}`);
+
+            if (response.status === 201) {
+                await this.loadSnapshots();
+            } else {
+                this.renderSnapshots(await response.json());
+            }
+            this.showPopup(success, 'success');
+        } catch (error) {
+            console.error('Snapshot request failed:', error);
+            this.showPopup(error.message, 'error');
+        } finally {
+            this.setLoading(false);
+        }
+    },
+
+    async createSnapshot() {
+        const input = document.getElementById('snapshotName');
+        const name = input.value.trim();
+        if (!name) {
+            this.showPopup('Please enter a snapshot name', 'warning');
+            return;
+        }
+
+        await this.snapshotRequest('/api/snapshots', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ name })
+        }, 'Snapshot saved');
+        input.value = '';
+    },
+
+    async restoreSnapshot(name) {
+        if (!confirm(`Restore snapshot "${name}"? Changes since then will be lost.`)) return;
+
+        await this.snapshotRequest('/api/snapshots/restore', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ name })
+        }, 'Snapshot restored');
+        this.clearResults();
+    },
+
+    async deleteSnapshot(name) {
+        await this.snapshotRequest(`/api/snapshots?name=${encodeURIComponent(name)}`, { method: 'DELETE' }, 'Snapshot deleted');
+    },
+
+    async forkSession() {
+        if (!this.sessionID) return;
+
+        try {
+            this.setLoading(true);
+            const response = await fetch('/api/session/fork', { method: 'POST' });
+            if (!response.ok) throw new Error((await response.text()).trim() || `HTTP ${response.status}`);
+
+            const data = await response.json();
+            const link = window.location.origin + data.url;
+            try {
+                await navigator.clipboard.writeText(link);
+                this.showPopup('Share link copied to clipboard', 'success');
+            } catch (error) {
+                prompt('Share this link:', link);
+            }
+        } catch (error) {
+            console.error('Fork failed:', error);
+            this.showPopup(error.message, 'error');
+        } finally {
+            this.setLoading(false);
+        }
+    },
+
     setupEventListeners() {
         document.getElementById('runQueryBtn').addEventListener('click', () => this.runQuery());
         document.getElementById('query').addEventListener('keydown', (e) => {
             if (e.ctrlKey && e.key === 'Enter') this.runQuery();
         });
         document.getElementById('clearSessionBtn').addEventListener('click', () => this.logout());
+        const cancelBtn = document.getElementById('cancelQueryBtn');
+        if (cancelBtn) cancelBtn.addEventListener('click', () => this.cancelQuery());
+        const resetBtn = document.getElementById('resetSessionBtn');
+        if (resetBtn) resetBtn.addEventListener('click', () => this.resetSession());
+        const statefulToggle = document.getElementById('statefulToggle');
+        if (statefulToggle) statefulToggle.addEventListener('change', () => this.setStateful(statefulToggle.checked));
+        const forkBtn = document.getElementById('forkSessionBtn');
+        if (forkBtn) forkBtn.addEventListener('click', () => this.forkSession());
+        const snapshotList = document.getElementById('snapshotList');
+        if (snapshotList) {
+            document.getElementById('createSnapshotBtn').addEventListener('click', () => this.createSnapshot());
+            snapshotList.addEventListener('click', (e) => {
+                const btn = e.target.closest('button');
+                if (!btn) return;
+                if (btn.dataset.restore) this.restoreSnapshot(btn.dataset.restore);
+                if (btn.dataset.delete) this.deleteSnapshot(btn.dataset.delete);
+            });
+        }
+        const schemaBtn = document.getElementById('showSchemaBtn');
+        if (schemaBtn) schemaBtn.addEventListener('click', () => this.loadSchema());
+        const explainBtn = document.getElementById('explainQueryBtn');
+        if (explainBtn) explainBtn.addEventListener('click', () => this.explainQuery());
+        const datasetSelect = document.getElementById('datasetSelect');
+        if (datasetSelect) {
+            datasetSelect.addEventListener('change', async () => {
+                this.clearResults();
+                await this.initializeSession(datasetSelect.value);
+            });
+        }
         document.getElementById('clearQueryBtn').addEventListener('click', () => {
             this.clearQuery();
             this.showPopup('Query cleared', 'info');
@@ -187,6 +682,10 @@ const QueryLabApp = {
     setLoading(isLoading) {
         this.isLoading = isLoading;
         const button = document.getElementById('runQueryBtn');
+        const explainBtn = document.getElementById('explainQueryBtn');
+        if (explainBtn) explainBtn.disabled = isLoading;
+        const cancelBtn = document.getElementById('cancelQueryBtn');
+        if (cancelBtn) cancelBtn.style.display = isLoading && this.queryID ? '' : 'none';
 
         if (isLoading) {
             button.disabled = true;
@@ -21,10 +21,10 @@ const QueryLabUtils = {
     // Download results as CSV
     downloadCsv(columns, rows, filename = 'querylab_results.csv') {
         const csvContent = [
-            columns.join(','),
+            columns.map(col => typeof col === 'string' ? col : col.name).join(','),
             ...rows.map(row => row.map(cell => {
                 if (cell === null) return '';
-                const str = cell.toString();
+                const str = typeof cell === 'object' ? JSON.stringify(cell) : cell.toString();
                 // Escape quotes and wrap in quotes if contains comma or quote
                 if (str.includes(',') || str.includes('"') || str.includes('\n')) {
                     return `"${str.replace(/"/g, '""')}"`;
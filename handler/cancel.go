@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// validQueryID limits client-chosen query IDs to something safe to log
+var validQueryID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type CancelRequest struct {
+	QueryID string `json:"query_id"` // Optional, cancels every query of the session when empty
+}
+
+type CancelResponse struct {
+	Cancelled []string `json:"cancelled"` // IDs of the queries that were signalled
+}
+
+// runningQuery is a query in flight on a sandbox backend
+type runningQuery struct {
+	sessionID string
+	pid       int
+	started   time.Time
+}
+
+// queryRegistry tracks the running queries by ID so they can be cancelled
+type queryRegistry struct {
+	mu      sync.Mutex
+	queries map[string]runningQuery
+}
+
+func newQueryRegistry() *queryRegistry {
+	return &queryRegistry{queries: make(map[string]runningQuery)}
+}
+
+// register adds a query, returning false if the ID is already running
+func (q *queryRegistry) register(id, sessionID string, pid int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, exists := q.queries[id]; exists {
+		return false
+	}
+	q.queries[id] = runningQuery{sessionID: sessionID, pid: pid, started: time.Now()}
+	return true
+}
+
+func (q *queryRegistry) unregister(id string) {
+	q.mu.Lock()
+	delete(q.queries, id)
+	q.mu.Unlock()
+}
+
+// forSession returns the running queries of a session, or only the one
+// with the given ID when it is not empty
+func (q *queryRegistry) forSession(sessionID, id string) map[string]runningQuery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	out := make(map[string]runningQuery)
+	for qid, rq := range q.queries {
+		if rq.sessionID == sessionID && (id == "" || qid == id) {
+			out[qid] = rq
+		}
+	}
+	return out
+}
+
+// trackQuery registers the backend of conn under the query ID so
+// POST /api/query/cancel can signal it. On failure it writes the error
+// response and returns false; otherwise the caller unregisters the query
+// when it is done.
+func (h *Handler) trackQuery(ctx context.Context, w http.ResponseWriter, conn *sql.Conn, sessionID, queryID string) bool {
+	var pid int
+	if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		slog.Error("Failed to read backend pid",
+			"session_id", sessionID,
+			"error", err,
+		)
+		http.Error(w, "db connection failed", 500)
+		return false
+	}
+	if !h.queries.register(queryID, sessionID, pid) {
+		http.Error(w, "query id already running", http.StatusConflict)
+		return false
+	}
+	w.Header().Set("X-Query-ID", queryID)
+	return true
+}
+
+func newQueryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// CancelQuery cancels a running query of the session with pg_cancel_backend.
+// The cancelled query returns a "canceling statement due to user request" error.
+func (h *Handler) CancelQuery(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := h.getSessionIDFromCookie(r)
+	if err != nil {
+		slog.Error("No session cookie found", "error", err)
+		http.Error(w, "session required", http.StatusUnauthorized)
+		return
+	}
+
+	var req CancelRequest
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			slog.Error("Failed to decode cancel request", "error", err)
+			http.Error(w, "bad request", 400)
+			return
+		}
+	}
+	if req.QueryID == "" {
+		req.QueryID = r.URL.Query().Get("query_id")
+	}
+
+	targets := h.queries.forSession(sessionID, req.QueryID)
+	if req.QueryID != "" && len(targets) == 0 {
+		http.Error(w, "query not found", http.StatusNotFound)
+		return
+	}
+
+	resp := CancelResponse{Cancelled: []string{}}
+	for id, rq := range targets {
+		ok, err := h.Sandbox.CancelBackend(r.Context(), sessionID, rq.pid)
+		if err != nil {
+			slog.Error("Failed to cancel query",
+				"session_id", sessionID,
+				"query_id", id,
+				"error", err,
+			)
+			continue
+		}
+		if ok {
+			resp.Cancelled = append(resp.Cancelled, id)
+		}
+		slog.Info("Query cancelled",
+			"session_id", sessionID,
+			"query_id", id,
+			"pid", rq.pid,
+			"signalled", ok,
+			"running_for", time.Since(rq.started),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidQueryID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"4f1c9a0b2d3e4f56", true},
+		{"my-query_1", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"", false},
+		{"with space", false},
+		{"new\nline", false},
+		{"../etc", false},
+	}
+	for _, tt := range tests {
+		if got := validQueryID.MatchString(tt.id); got != tt.want {
+			t.Errorf("validQueryID.MatchString(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+
+	if id := newQueryID(); !validQueryID.MatchString(id) {
+		t.Errorf("newQueryID() = %q is not a valid query ID", id)
+	}
+}
+
+func TestQueryRegistry(t *testing.T) {
+	q := newQueryRegistry()
+	if !q.register("a", "s1", 101) || !q.register("b", "s1", 102) || !q.register("c", "s2", 201) {
+		t.Fatal("register failed for a new ID")
+	}
+	if q.register("a", "s2", 202) {
+		t.Error("register accepted an ID that is already running")
+	}
+
+	tests := []struct {
+		sessionID string
+		id        string
+		want      []string
+	}{
+		{"s1", "", []string{"a", "b"}},
+		{"s1", "b", []string{"b"}},
+		{"s2", "a", nil}, // another session's query
+		{"s3", "", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for id := range q.forSession(tt.sessionID, tt.id) {
+			got = append(got, id)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("forSession(%q, %q) = %v, want %v", tt.sessionID, tt.id, got, tt.want)
+		}
+	}
+
+	q.unregister("a")
+	if _, ok := q.forSession("s1", "a")["a"]; ok {
+		t.Error("unregistered query is still listed")
+	}
+	if !q.register("a", "s2", 202) {
+		t.Error("register failed for an ID that was unregistered")
+	}
+}
+
+func TestCancelQueryErrors(t *testing.T) {
+	h := &Handler{queries: newQueryRegistry()}
+	h.queries.register("other", "s2", 201)
+
+	tests := []struct {
+		name     string
+		cookie   string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"no session", "", `{}`, http.StatusUnauthorized, "session required\n"},
+		{"bad request", "s1", `{`, http.StatusBadRequest, "bad request\n"},
+		{"unknown query", "s1", `{"query_id": "missing"}`, http.StatusNotFound, "query not found\n"},
+		{"another session's query", "s1", `{"query_id": "other"}`, http.StatusNotFound, "query not found\n"},
+		{"nothing running", "s1", ``, http.StatusOK, `{"cancelled":[]}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/query/cancel", strings.NewReader(tt.body))
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "querylab_session", Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			h.CancelQuery(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("CancelQuery() = %d %q, want %d %q", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
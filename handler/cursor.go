@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Queries run through a cursor while a result limit is set, so the server
+// stops producing rows once the budget runs out instead of sending every
+// row of a huge result only to have it discarded.
+
+const (
+	// resultCursor names the cursor and the savepoint guarding it
+	resultCursor = "querylab_rows"
+
+	// cursorFetchSize is the most rows fetched per round trip
+	cursorFetchSize = 100
+)
+
+// cursorPrefix turns a query into the cursor declaration
+const cursorPrefix = "DECLARE " + resultCursor + " NO SCROLL CURSOR FOR "
+
+// cursorable reports whether a statement is a query that may run as a cursor
+func cursorable(text string) bool {
+	switch strings.ToUpper(firstKeyword(text)) {
+	case "SELECT", "VALUES", "TABLE", "WITH":
+		return true
+	}
+	return false
+}
+
+// errStatementTimeout is what a query read through a cursor fails with
+// once it ran out of statement_timeout
+var errStatementTimeout = &pq.Error{
+	Severity: "ERROR",
+	Code:     "57014", // query_canceled
+	Message:  "canceling statement due to statement timeout",
+}
+
+// runCursor reads the rows of a query through a cursor. Outside a
+// transaction block the cursor gets a transaction of its own, inside one
+// a savepoint, so a query that can't be declared as a cursor, like
+// SELECT INTO or WITH holding an INSERT, leaves no trace. For those it
+// returns false and the query has to run directly.
+//
+// statement_timeout limits each statement, so on its own it would give
+// every FETCH the full time. The query gets it as a whole instead, as it
+// would running directly; running out of it closes the connection.
+func runCursor(ctx context.Context, queryer driver.QueryerContext, stmt statement, res *StatementResult, budget *resultBudget, rw rowWriter) (bool, error) {
+	inTx, timeout, err := cursorState(ctx, queryer)
+	if err != nil {
+		// A failed transaction, the query fails the same way on its own
+		return false, nil
+	}
+
+	cursorCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		cursorCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	ran, err := readCursor(cursorCtx, queryer, stmt, inTx, res, budget, rw)
+	if err != nil && cursorCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		err = errStatementTimeout
+	}
+	return ran, err
+}
+
+// readCursor declares the cursor and reads its rows, see runCursor
+func readCursor(ctx context.Context, queryer driver.QueryerContext, stmt statement, inTx bool, res *StatementResult, budget *resultBudget, rw rowWriter) (bool, error) {
+	begin, commit, undo := []string{"BEGIN"}, []string{"COMMIT"}, []string{"ROLLBACK"}
+	if inTx {
+		begin = []string{"SAVEPOINT " + resultCursor}
+		commit = []string{"CLOSE " + resultCursor, "RELEASE SAVEPOINT " + resultCursor}
+		undo = []string{"ROLLBACK TO SAVEPOINT " + resultCursor, "RELEASE SAVEPOINT " + resultCursor}
+	}
+
+	if err := execRaw(ctx, queryer, begin...); err != nil {
+		return true, err
+	}
+	if err := execRaw(ctx, queryer, cursorPrefix+stmt.Text); err != nil {
+		if err := execRaw(ctx, queryer, undo...); err != nil {
+			return true, err
+		}
+		return false, nil
+	}
+
+	if err := fetchCursor(ctx, queryer, res, budget, rw); err != nil {
+		// Inside a transaction block the error fails the transaction, as it
+		// would without the cursor
+		if !inTx {
+			_ = execRaw(ctx, queryer, "ROLLBACK")
+		}
+		return true, err
+	}
+
+	res.RowsAffected = int64(res.numRows)
+	res.CommandTag = commandTag("SELECT", &res.RowsAffected)
+	return true, execRaw(ctx, queryer, commit...)
+}
+
+// fetchCursor reads the rows of the declared cursor in batches until they
+// or the budget run out. One row more than the row limit is asked for, so
+// the budget can tell whether the result was cut.
+func fetchCursor(ctx context.Context, queryer driver.QueryerContext, res *StatementResult, budget *resultBudget, rw rowWriter) error {
+	for first := true; ; first = false {
+		n := cursorFetchSize
+		if budget.maxRows > 0 {
+			n = min(n, budget.maxRows-res.numRows+1)
+		}
+
+		rows, err := queryer.QueryContext(ctx, fmt.Sprintf("FETCH %d FROM %s", n, resultCursor), nil)
+		if err != nil {
+			return err
+		}
+		if first {
+			res.Columns = columnsOf(rows, res.nullable)
+			err = rw.begin(res)
+		}
+
+		read := 0
+		if err == nil {
+			read, err = passRows(rows, res, budget, rw)
+		}
+		if cerr := rows.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil || res.Truncated || read < n {
+			return err
+		}
+	}
+}
+
+// cursorState reports whether the connection is inside a transaction
+// block and the statement_timeout in effect, 0 for none. It fails in a
+// failed transaction.
+func cursorState(ctx context.Context, queryer driver.QueryerContext) (bool, time.Duration, error) {
+	// Outside a transaction block every statement is its own transaction,
+	// so the transaction started with this statement
+	rows, err := queryer.QueryContext(ctx, `
+		SELECT now() <> statement_timestamp(), setting::int8
+		FROM pg_settings WHERE name = 'statement_timeout'`, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	dest := make([]driver.Value, 2)
+	err = rows.Next(dest)
+	if cerr := rows.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	inTx, _ := dest[0].(bool)
+	ms, _ := dest[1].(int64)
+	return inTx, time.Duration(ms) * time.Millisecond, nil
+}
+
+// execRaw runs statements on a driver connection, discarding their rows
+func execRaw(ctx context.Context, queryer driver.QueryerContext, queries ...string) error {
+	for _, q := range queries {
+		rows, err := queryer.QueryContext(ctx, q, nil)
+		if err != nil {
+			return err
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorable(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"SELECT 1", true},
+		{"  (select 1)", true},
+		{"-- comment\nTABLE t", true},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", true},
+		{"VALUES (1), (2)", true},
+		{"INSERT INTO t VALUES (1) RETURNING *", false},
+		{"EXPLAIN SELECT 1", false},
+		{"SHOW search_path", false},
+	}
+
+	for _, tt := range tests {
+		if got := cursorable(tt.text); got != tt.want {
+			t.Errorf("cursorable(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+// slowCursor is a connection whose cursor returns as many rows as asked
+// for, each FETCH after a delay
+type slowCursor struct {
+	timeout time.Duration // statement_timeout it reports
+	delay   time.Duration // time each FETCH takes
+	queries []string
+}
+
+func (c *slowCursor) QueryContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.queries = append(c.queries, strings.TrimSpace(query))
+	switch {
+	case strings.Contains(query, "statement_timestamp()"):
+		return &fakeRows{cols: []string{"in_tx", "setting"}, rows: [][]driver.Value{{false, c.timeout.Milliseconds()}}}, nil
+	case strings.HasPrefix(query, "FETCH"):
+		var n int
+		fmt.Sscanf(query, "FETCH %d", &n)
+		select {
+		case <-time.After(c.delay):
+			rows := &fakeRows{cols: []string{"n"}}
+			for i := range n {
+				rows.rows = append(rows.rows, []driver.Value{int64(i)})
+			}
+			return rows, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestRunCursorTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr error
+	}{
+		// Every FETCH stays within the timeout, the query as a whole doesn't
+		{"query runs out of time", 50 * time.Millisecond, errStatementTimeout},
+		{"no statement_timeout", 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &slowCursor{timeout: tt.timeout, delay: 20 * time.Millisecond}
+			res := StatementResult{}
+			budget := &resultBudget{maxRows: 3 * cursorFetchSize}
+
+			ran, err := runCursor(context.Background(), conn, statement{Text: "SELECT 1"}, &res, budget, collectRows{})
+			if !ran || err != tt.wantErr {
+				t.Fatalf("runCursor() = %v, %v, want true, %v", ran, err, tt.wantErr)
+			}
+			if err == nil && !res.Truncated {
+				t.Errorf("result of %d rows not truncated", len(res.Rows))
+			}
+		})
+	}
+}
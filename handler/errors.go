@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// QueryError is the structured form of a failed statement's error. Besides
+// the message it carries what PostgreSQL reports about the error, and where
+// in the submitted query it happened.
+type QueryError struct {
+	Message  string `json:"message"`
+	Severity string `json:"severity,omitempty"`
+	Code     string `json:"code,omitempty"`       // SQLSTATE, e.g. 23505
+	CodeName string `json:"code_name,omitempty"`  // e.g. unique_violation
+	Class    string `json:"class_name,omitempty"` // e.g. integrity_constraint_violation
+	Detail   string `json:"detail,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+	Where    string `json:"where,omitempty"`
+
+	// Position is the 1-based character position in the statement. Line
+	// and Column locate it in the whole query, both 1-based.
+	Position int `json:"position,omitempty"`
+	Line     int `json:"line,omitempty"`
+	Column   int `json:"column,omitempty"`
+
+	// Objects involved, for the errors that name them
+	Schema     string `json:"schema,omitempty"`
+	Table      string `json:"table,omitempty"`
+	ColumnName string `json:"column_name,omitempty"`
+	DataType   string `json:"data_type,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+}
+
+// queryErrorOf describes the error of a statement. Errors that don't come
+// from PostgreSQL only have a message.
+func queryErrorOf(err error, stmt statement) *QueryError {
+	qe := &QueryError{Message: err.Error()}
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return qe
+	}
+
+	qe.Message = pqErr.Message
+	qe.Severity = pqErr.Severity
+	qe.Code = string(pqErr.Code)
+	qe.CodeName = pqErr.Code.Name()
+	qe.Class = pqErr.Code.Class().Name()
+	qe.Detail = pqErr.Detail
+	qe.Hint = pqErr.Hint
+	qe.Where = pqErr.Where
+	qe.Schema = pqErr.Schema
+	qe.Table = pqErr.Table
+	qe.ColumnName = pqErr.Column
+	qe.DataType = pqErr.DataTypeName
+	qe.Constraint = pqErr.Constraint
+
+	if pos, err := strconv.Atoi(pqErr.Position); err == nil && pos > 0 {
+		qe.Position = pos
+		qe.Line, qe.Column = locate(stmt, pos)
+	}
+	return qe
+}
+
+// locate turns a 1-based character position in a statement into the line
+// and column in the query the statement came from
+func locate(stmt statement, pos int) (int, int) {
+	// Position counts characters, not bytes
+	text := stmt.Text
+	for i := 1; i < pos && text != ""; i++ {
+		_, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+	}
+	before := stmt.Text[:len(stmt.Text)-len(text)]
+
+	newlines := strings.Count(before, "\n")
+	if newlines == 0 {
+		return stmt.Line, stmt.Column + utf8.RuneCountInString(before)
+	}
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	return stmt.Line + newlines, utf8.RuneCountInString(before[lineStart:]) + 1
+}
+
+// behind returns the statement as it runs behind a prefix such as EXPLAIN,
+// placed so that errors located in it still point into the query. Their
+// position is fixed with shiftErrorPosition.
+func (s statement) behind(prefix string) statement {
+	if prefix == "" {
+		return s
+	}
+	return statement{
+		Text:   prefix + s.Text,
+		Line:   s.Line,
+		Column: s.Column - utf8.RuneCountInString(prefix),
+	}
+}
+
+// shiftErrorPosition makes the error position of a statement that ran
+// behind a prefix count from the start of the statement again. Positions
+// inside the prefix are dropped.
+func shiftErrorPosition(res *StatementResult, prefix string) {
+	if res.ErrorDetail == nil || res.ErrorDetail.Position == 0 {
+		return
+	}
+	res.ErrorDetail.Position -= utf8.RuneCountInString(prefix)
+	if res.ErrorDetail.Position < 1 {
+		res.ErrorDetail.Position, res.ErrorDetail.Line, res.ErrorDetail.Column = 0, 0, 0
+	}
+}
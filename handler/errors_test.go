@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestLocate(t *testing.T) {
+	tests := []struct {
+		name   string
+		stmt   statement
+		pos    int
+		line   int
+		column int
+	}{
+		{"start", statement{Text: "SELECT foo", Line: 1, Column: 1}, 1, 1, 1},
+		{"first line", statement{Text: "SELECT foo", Line: 1, Column: 1}, 8, 1, 8},
+		{"statement mid line", statement{Text: "SELECT foo", Line: 3, Column: 5}, 8, 3, 12},
+		{"later line", statement{Text: "SELECT\n  foo FROM t", Line: 3, Column: 5}, 10, 4, 3},
+		{"after multibyte", statement{Text: "SELECT 'é', bar", Line: 1, Column: 1}, 13, 1, 13},
+		{"multibyte on later line", statement{Text: "SELECT 'é',\n'é', bar", Line: 2, Column: 1}, 18, 3, 6},
+		{"past the end", statement{Text: "SELECT", Line: 1, Column: 1}, 20, 1, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, column := locate(tt.stmt, tt.pos)
+			if line != tt.line || column != tt.column {
+				t.Errorf("locate(%q, %d) = %d, %d, want %d, %d", tt.stmt.Text, tt.pos, line, column, tt.line, tt.column)
+			}
+		})
+	}
+}
+
+func TestErrorBehindPrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		stmt     statement
+		prefix   string
+		position string // as PostgreSQL reports it, counting the prefix
+		wantPos  int
+		line     int
+		column   int
+	}{
+		{"no prefix", statement{Text: "SELECT foo", Line: 2, Column: 3}, "", "8", 8, 2, 10},
+		{"in the statement", statement{Text: "SELECT foo", Line: 2, Column: 3}, "EXPLAIN ", "16", 8, 2, 10},
+		{"on a later line", statement{Text: "SELECT\nfoo", Line: 2, Column: 3}, "EXPLAIN ", "16", 8, 3, 1},
+		{"multibyte prefix", statement{Text: "SELECT foo", Line: 1, Column: 1}, "/* é */ ", "16", 8, 1, 8},
+		{"in the prefix", statement{Text: "SELECT foo", Line: 1, Column: 1}, "EXPLAIN (FORMAT JSON) ", "3", 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := &pq.Error{Code: "42703", Message: "column \"foo\" does not exist", Position: tt.position}
+			res := StatementResult{ErrorDetail: queryErrorOf(err, tt.stmt.behind(tt.prefix))}
+			shiftErrorPosition(&res, tt.prefix)
+
+			got := res.ErrorDetail
+			if got.Position != tt.wantPos || got.Line != tt.line || got.Column != tt.column {
+				t.Errorf("error at position %d, line %d, column %d, want %d, %d, %d",
+					got.Position, got.Line, got.Column, tt.wantPos, tt.line, tt.column)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// StatementResult is the outcome of one statement of a script
+type StatementResult struct {
+	Statement     string          `json:"statement"`
+	StatementType string          `json:"statement_type"`
+	Columns       []Column        `json:"columns"`
+	Rows          [][]interface{} `json:"rows"`
+	RowsAffected  int64           `json:"rows_affected"`
+	CommandTag    string          `json:"command_tag,omitempty"`
+	DurationMs    float64         `json:"duration_ms"`
+	Truncated     bool            `json:"truncated,omitempty"`
+	LimitType     string          `json:"limit_type,omitempty"` // "rows" or "bytes", the limit that truncated the rows
+	Limit         int64           `json:"limit,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	ErrorDetail   *QueryError     `json:"error_detail,omitempty"`
+	Notices       []Notice        `json:"notices,omitempty"` // in the order the server sent them
+
+	numRows  int     // rows passed to the rowWriter, which may not keep them
+	nullable []*bool // nullability of the columns, from describing the statement
+}
+
+// rowWriter receives the rows of a statement as they are read. begin is
+// called once the columns are known, end after the statement finished.
+type rowWriter interface {
+	begin(res *StatementResult) error
+	row(res *StatementResult, values []interface{}) error
+	end(res *StatementResult) error
+}
+
+// collectRows keeps the rows in the result for a single JSON response
+type collectRows struct{}
+
+func (collectRows) begin(*StatementResult) error { return nil }
+
+func (collectRows) row(res *StatementResult, values []interface{}) error {
+	res.Rows = append(res.Rows, values)
+	return nil
+}
+
+func (collectRows) end(*StatementResult) error { return nil }
+
+// resultBudget tracks the result limits of one request. The row limit
+// applies to every statement, the byte limit to all rows of the request.
+type resultBudget struct {
+	maxRows   int
+	maxBytes  int64
+	bytesLeft int64
+}
+
+func newResultBudget(opts Options) *resultBudget {
+	return &resultBudget{maxRows: opts.MaxRows, maxBytes: opts.MaxBytes, bytesLeft: opts.MaxBytes}
+}
+
+// limited reports whether the budget has a limit at all
+func (b *resultBudget) limited() bool {
+	return b.maxRows > 0 || b.maxBytes > 0
+}
+
+// admit reports whether another row of the given size fits, and if not
+// marks res as truncated by the limit that was hit
+func (b *resultBudget) admit(res *StatementResult, size int64) bool {
+	switch {
+	case b.maxRows > 0 && res.numRows >= b.maxRows:
+		res.Truncated, res.LimitType, res.Limit = true, "rows", int64(b.maxRows)
+		return false
+	case b.maxBytes > 0 && size > b.bytesLeft:
+		res.Truncated, res.LimitType, res.Limit = true, "bytes", b.maxBytes
+		return false
+	}
+	b.bytesLeft -= size
+	return true
+}
+
+// taggedRows is implemented by lib/pq rows, which keep the command tag
+// of the statement once all rows have been read
+type taggedRows interface {
+	Tag() string
+	Result() driver.Result
+}
+
+// noticeConn is implemented by the sandbox connections, which pass on the
+// notices lib/pq receives while a statement runs
+type noticeConn interface {
+	SetNoticeHandler(func(*pq.Error))
+}
+
+// Notice is a NOTICE, WARNING or other non-error message the server sent
+// while a statement ran, e.g. from RAISE NOTICE
+type Notice struct {
+	Statement int    `json:"statement"` // index of the statement in the script
+	Severity  string `json:"severity"`
+	Code      string `json:"code,omitempty"`
+	Message   string `json:"message"`
+	Detail    string `json:"detail,omitempty"`
+	Hint      string `json:"hint,omitempty"`
+	Where     string `json:"where,omitempty"`
+}
+
+// runScript runs the statements of a script in order on conn and stops at
+// the first failing one, like psql's ON_ERROR_STOP. It only returns an
+// error when rw can't write a result, e.g. because the client went away.
+func runScript(ctx context.Context, conn *sql.Conn, stmts []statement, budget *resultBudget, rw rowWriter, sessionID string) ([]StatementResult, error) {
+	results := make([]StatementResult, 0, len(stmts))
+	for i, stmt := range stmts {
+		results = append(results, runStatement(ctx, conn, i, stmt, budget, rw))
+		res := &results[len(results)-1]
+		if err := rw.end(res); err != nil {
+			return results, err
+		}
+
+		if res.Error != "" {
+			slog.Error("Query execution failed",
+				"session_id", sessionID,
+				"statement_index", i,
+				"query", stmt.Text,
+				"error", res.Error,
+			)
+			break
+		}
+	}
+	return results, nil
+}
+
+// runStatement executes a single statement on conn. It talks to the driver
+// connection directly because database/sql hides the command tag.
+// Statements that may return table columns are described first, for the
+// nullability of their columns.
+// With a result limit, queries run through a cursor so no rows are fetched
+// past the budget; their tag then counts the rows returned. Other
+// statements run directly and the rows past the budget are discarded
+// unread when the rows are closed.
+func runStatement(ctx context.Context, conn *sql.Conn, index int, stmt statement, budget *resultBudget, rw rowWriter) StatementResult {
+	res := StatementResult{
+		Statement: stmt.Text,
+		Columns:   []Column{},
+		Rows:      [][]interface{}{},
+	}
+	start := time.Now()
+
+	errPrefix := "" // text the failing statement ran behind
+	err := conn.Raw(func(dc any) error {
+		queryer, ok := dc.(driver.QueryerContext)
+		if !ok {
+			return errors.New("driver does not support direct queries")
+		}
+
+		if nc, ok := dc.(noticeConn); ok {
+			nc.SetNoticeHandler(func(e *pq.Error) {
+				res.Notices = append(res.Notices, Notice{
+					Statement: index,
+					Severity:  e.Severity,
+					Code:      string(e.Code),
+					Message:   e.Message,
+					Detail:    e.Detail,
+					Hint:      e.Hint,
+					Where:     e.Where,
+				})
+			})
+			defer nc.SetNoticeHandler(nil)
+		}
+
+		if describable(stmt.Text) {
+			nullable, err := columnNullability(ctx, dc, stmt.Text)
+			if err != nil {
+				return err
+			}
+			res.nullable = nullable
+		}
+
+		if budget.limited() && cursorable(stmt.Text) {
+			if ran, err := runCursor(ctx, queryer, stmt, &res, budget, rw); ran {
+				errPrefix = cursorPrefix
+				return err
+			}
+			// The statement runs again directly, with its notices
+			res.Notices = nil
+		}
+
+		rows, err := queryer.QueryContext(ctx, stmt.Text, nil)
+		if err != nil {
+			return err
+		}
+
+		// Close only once, lib/pq runs its cancel cleanup on every call.
+		// The command tag arrives after the last row, so close before reading it.
+		err = readRows(rows, &res, budget, rw)
+		if cerr := rows.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		if tagged, ok := rows.(taggedRows); ok {
+			res.RowsAffected, _ = tagged.Result().RowsAffected()
+			res.CommandTag = commandTag(tagged.Tag(), &res.RowsAffected)
+		}
+		return nil
+	})
+
+	res.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	res.StatementType = statementType(res.CommandTag, stmt.Text)
+	if err != nil {
+		res.Error = err.Error()
+		res.ErrorDetail = queryErrorOf(err, stmt.behind(errPrefix))
+		shiftErrorPosition(&res, errPrefix)
+	}
+	return res
+}
+
+// readRows passes the rows of a statement to rw until the budget runs out
+func readRows(rows driver.Rows, res *StatementResult, budget *resultBudget, rw rowWriter) error {
+	res.Columns = columnsOf(rows, res.nullable)
+	if err := rw.begin(res); err != nil {
+		return err
+	}
+	_, err := passRows(rows, res, budget, rw)
+	return err
+}
+
+// passRows passes rows to rw until they or the budget run out. It returns
+// the number of rows read, including one the budget turned away.
+func passRows(rows driver.Rows, res *StatementResult, budget *resultBudget, rw rowWriter) (int, error) {
+	dest := make([]driver.Value, len(res.Columns))
+	for read := 0; ; read++ {
+		if err := rows.Next(dest); err != nil {
+			if err == io.EOF {
+				return read, nil
+			}
+			return read, err
+		}
+
+		// Encode values according to their column types
+		row := make([]interface{}, len(dest))
+		for i, v := range dest {
+			row[i] = encodeValue(v, res.Columns[i].Type)
+		}
+
+		var size int64
+		if budget.maxBytes > 0 {
+			encoded, err := json.Marshal(row)
+			if err != nil {
+				return read, err
+			}
+			size = int64(len(encoded)) + 1 // and the separating comma
+		}
+		if !budget.admit(res, size) {
+			return read + 1, nil
+		}
+		if err := rw.row(res, row); err != nil {
+			return read, err
+		}
+		res.numRows++
+	}
+}
+
+// Statement types reported in results
+const (
+	stmtQuery       = "query"       // SELECT, VALUES, TABLE
+	stmtDML         = "dml"         // INSERT, UPDATE, DELETE, MERGE, COPY
+	stmtDDL         = "ddl"         // CREATE, ALTER, DROP, TRUNCATE, COMMENT
+	stmtDCL         = "dcl"         // GRANT, REVOKE
+	stmtTransaction = "transaction" // BEGIN, COMMIT, ROLLBACK, SAVEPOINT
+	stmtUtility     = "utility"     // everything else: SET, SHOW, EXPLAIN, DO, ...
+)
+
+// statementType classifies a statement by its command tag, or by its first
+// keyword when it failed before producing one
+func statementType(tag, text string) string {
+	command := tag
+	if command == "" {
+		command = firstKeyword(text)
+	}
+	verb, _, _ := strings.Cut(strings.ToUpper(command), " ")
+
+	switch verb {
+	case "SELECT", "VALUES", "TABLE", "WITH":
+		return stmtQuery
+	case "INSERT", "UPDATE", "DELETE", "MERGE", "COPY":
+		return stmtDML
+	case "CREATE", "ALTER", "DROP", "TRUNCATE", "COMMENT":
+		return stmtDDL
+	case "GRANT", "REVOKE":
+		return stmtDCL
+	case "BEGIN", "START", "COMMIT", "END", "ROLLBACK", "ABORT", "SAVEPOINT", "RELEASE", "PREPARE":
+		// PREPARE alone is a prepared statement, not PREPARE TRANSACTION
+		if verb == "PREPARE" && !strings.Contains(strings.ToUpper(command), "TRANSACTION") {
+			return stmtUtility
+		}
+		return stmtTransaction
+	}
+	return stmtUtility
+}
+
+// firstKeyword returns the first word of a statement, skipping comments
+// and opening parentheses
+func firstKeyword(text string) string {
+	for len(text) > 0 {
+		text = strings.TrimLeft(text, " \t\r\n(")
+		switch {
+		case strings.HasPrefix(text, "--"):
+			if i := strings.IndexByte(text, '\n'); i >= 0 {
+				text = text[i+1:]
+			} else {
+				text = ""
+			}
+		case strings.HasPrefix(text, "/*"):
+			if i := strings.Index(text, "*/"); i >= 0 {
+				text = text[i+2:]
+			} else {
+				text = ""
+			}
+		default:
+			end := 0
+			for end < len(text) && isIdentChar(text[end]) {
+				end++
+			}
+			return text[:end]
+		}
+	}
+	return ""
+}
+
+// commandTag rebuilds the PostgreSQL command tag from the command name lib/pq
+// reports and the affected row count, e.g. "UPDATE 3" or "INSERT 0 1".
+// Tags lib/pq doesn't parse, such as "MERGE 2", are passed through and
+// their row count is stored in affected.
+func commandTag(command string, affected *int64) string {
+	switch command {
+	case "":
+		return ""
+	case "INSERT":
+		return fmt.Sprintf("INSERT 0 %d", *affected)
+	case "SELECT", "UPDATE", "DELETE", "FETCH", "MOVE", "COPY":
+		return fmt.Sprintf("%s %d", command, *affected)
+	}
+
+	if i := strings.LastIndexByte(command, ' '); i > 0 {
+		if n, err := strconv.ParseInt(command[i+1:], 10, 64); err == nil {
+			*affected = n
+		}
+	}
+	return command
+}
@@ -0,0 +1,62 @@
+package handler
+
+import "testing"
+
+func TestCommandTag(t *testing.T) {
+	tests := []struct {
+		command      string
+		affected     int64
+		want         string
+		wantAffected int64
+	}{
+		{"", 0, "", 0},
+		{"INSERT", 1, "INSERT 0 1", 1},
+		{"SELECT", 5, "SELECT 5", 5},
+		{"UPDATE", 3, "UPDATE 3", 3},
+		{"DELETE", 0, "DELETE 0", 0},
+		{"MERGE 2", 0, "MERGE 2", 2},
+		{"CREATE TABLE", 0, "CREATE TABLE", 0},
+		{"BEGIN", 0, "BEGIN", 0},
+	}
+
+	for _, tt := range tests {
+		affected := tt.affected
+		got := commandTag(tt.command, &affected)
+		if got != tt.want || affected != tt.wantAffected {
+			t.Errorf("commandTag(%q, %d) = %q, %d, want %q, %d",
+				tt.command, tt.affected, got, affected, tt.want, tt.wantAffected)
+		}
+	}
+}
+
+func TestStatementType(t *testing.T) {
+	tests := []struct {
+		tag  string
+		text string
+		want string
+	}{
+		{"SELECT 3", "SELECT * FROM t", stmtQuery},
+		{"", "  -- comment\n(SELECT 1) UNION (SELECT 2)", stmtQuery},
+		{"", "with x as (select 1) select * from x", stmtQuery},
+		{"", "VALUES (1)", stmtQuery},
+		{"INSERT 0 1", "INSERT INTO t VALUES (1)", stmtDML},
+		{"", "/* comment */ DELETE FROM t", stmtDML},
+		{"MERGE 2", "MERGE INTO t USING s ON true WHEN MATCHED THEN DELETE", stmtDML},
+		{"CREATE TABLE", "CREATE TABLE t (id int)", stmtDDL},
+		{"", "TRUNCATE t", stmtDDL},
+		{"GRANT", "GRANT SELECT ON t TO r", stmtDCL},
+		{"BEGIN", "BEGIN", stmtTransaction},
+		{"", "start transaction", stmtTransaction},
+		{"PREPARE TRANSACTION", "PREPARE TRANSACTION 'x'", stmtTransaction},
+		{"PREPARE", "PREPARE p AS SELECT 1", stmtUtility},
+		{"SET", "SET search_path TO public", stmtUtility},
+		{"DO", "DO $$ BEGIN END $$", stmtUtility},
+		{"", "", stmtUtility},
+	}
+
+	for _, tt := range tests {
+		if got := statementType(tt.tag, tt.text); got != tt.want {
+			t.Errorf("statementType(%q, %q) = %q, want %q", tt.tag, tt.text, got, tt.want)
+		}
+	}
+}
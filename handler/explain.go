@@ -0,0 +1,529 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pouyatavakoli/QueryLab/db"
+)
+
+// explainSavepoint rolls back EXPLAIN ANALYZE inside an open transaction
+const explainSavepoint = "querylab_explain"
+
+// explainCleanupTimeout bounds the rollback after EXPLAIN ANALYZE
+const explainCleanupTimeout = 5 * time.Second
+
+type ExplainRequest struct {
+	Query   string `json:"query"`    // A single statement
+	Analyze bool   `json:"analyze"`  // Run the statement and report actual rows and times
+	Buffers bool   `json:"buffers"`  // Report buffer usage, needs analyze for the actual counts
+	QueryID string `json:"query_id"` // Optional, lets the client cancel the statement while it runs
+}
+
+// ExplainResponse holds the plan of a statement as a tree and as the text
+// psql would show
+type ExplainResponse struct {
+	QueryID     string      `json:"query_id"`
+	Analyze     bool        `json:"analyze"`
+	Buffers     bool        `json:"buffers"`
+	Plan        *PlanNode   `json:"plan,omitempty"`
+	Text        string      `json:"text,omitempty"`
+	PlanningMs  *float64    `json:"planning_ms,omitempty"`
+	ExecutionMs *float64    `json:"execution_ms,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	ErrorDetail *QueryError `json:"error_detail,omitempty"`
+	Notices     []Notice    `json:"notices"`
+	Stateful    bool        `json:"stateful"`
+	TxStatus    string      `json:"transaction_status,omitempty"`
+}
+
+// PlanNode is a node of a query plan. Costs are in the planner's units,
+// times in milliseconds. Like in PostgreSQL's output, rows and times are
+// per loop; the actual values are only set with analyze.
+type PlanNode struct {
+	NodeType           string `json:"node_type"`
+	ParentRelationship string `json:"parent_relationship,omitempty"`
+	SubplanName        string `json:"subplan_name,omitempty"`
+	ParallelAware      bool   `json:"parallel_aware,omitempty"`
+	JoinType           string `json:"join_type,omitempty"`
+	Strategy           string `json:"strategy,omitempty"`
+	Relation           string `json:"relation,omitempty"`
+	Schema             string `json:"schema,omitempty"`
+	Alias              string `json:"alias,omitempty"`
+	Index              string `json:"index,omitempty"`
+	CTEName            string `json:"cte_name,omitempty"`
+	FunctionName       string `json:"function_name,omitempty"`
+
+	StartupCost   float64 `json:"startup_cost"`
+	TotalCost     float64 `json:"total_cost"`
+	EstimatedRows float64 `json:"estimated_rows"`
+	Width         int     `json:"width"`
+
+	ActualStartupMs *float64 `json:"actual_startup_ms,omitempty"`
+	ActualTotalMs   *float64 `json:"actual_total_ms,omitempty"`
+	ActualRows      *float64 `json:"actual_rows,omitempty"`
+	Loops           *int64   `json:"loops,omitempty"` // 0 when the node never ran
+
+	Filter                  string   `json:"filter,omitempty"`
+	RowsRemovedByFilter     *float64 `json:"rows_removed_by_filter,omitempty"`
+	IndexCond               string   `json:"index_cond,omitempty"`
+	RecheckCond             string   `json:"recheck_cond,omitempty"`
+	HashCond                string   `json:"hash_cond,omitempty"`
+	MergeCond               string   `json:"merge_cond,omitempty"`
+	JoinFilter              string   `json:"join_filter,omitempty"`
+	RowsRemovedByJoinFilter *float64 `json:"rows_removed_by_join_filter,omitempty"`
+	SortKey                 []string `json:"sort_key,omitempty"`
+	SortMethod              string   `json:"sort_method,omitempty"`
+	GroupKey                []string `json:"group_key,omitempty"`
+
+	Buffers  *PlanBuffers `json:"buffers,omitempty"`
+	Children []*PlanNode  `json:"children"`
+}
+
+// PlanBuffers counts the blocks a plan node touched
+type PlanBuffers struct {
+	SharedHit     int64 `json:"shared_hit"`
+	SharedRead    int64 `json:"shared_read"`
+	SharedDirtied int64 `json:"shared_dirtied"`
+	SharedWritten int64 `json:"shared_written"`
+	TempRead      int64 `json:"temp_read"`
+	TempWritten   int64 `json:"temp_written"`
+}
+
+// rawPlan is a plan node as EXPLAIN (FORMAT JSON) writes it
+type rawPlan struct {
+	NodeType                string    `json:"Node Type"`
+	ParentRelationship      string    `json:"Parent Relationship"`
+	SubplanName             string    `json:"Subplan Name"`
+	ParallelAware           bool      `json:"Parallel Aware"`
+	JoinType                string    `json:"Join Type"`
+	Strategy                string    `json:"Strategy"`
+	RelationName            string    `json:"Relation Name"`
+	Schema                  string    `json:"Schema"`
+	Alias                   string    `json:"Alias"`
+	IndexName               string    `json:"Index Name"`
+	CTEName                 string    `json:"CTE Name"`
+	FunctionName            string    `json:"Function Name"`
+	StartupCost             float64   `json:"Startup Cost"`
+	TotalCost               float64   `json:"Total Cost"`
+	PlanRows                float64   `json:"Plan Rows"`
+	PlanWidth               int       `json:"Plan Width"`
+	ActualStartupTime       *float64  `json:"Actual Startup Time"`
+	ActualTotalTime         *float64  `json:"Actual Total Time"`
+	ActualRows              *float64  `json:"Actual Rows"`
+	ActualLoops             *int64    `json:"Actual Loops"`
+	Filter                  string    `json:"Filter"`
+	RowsRemovedByFilter     *float64  `json:"Rows Removed by Filter"`
+	IndexCond               string    `json:"Index Cond"`
+	RecheckCond             string    `json:"Recheck Cond"`
+	HashCond                string    `json:"Hash Cond"`
+	MergeCond               string    `json:"Merge Cond"`
+	JoinFilter              string    `json:"Join Filter"`
+	RowsRemovedByJoinFilter *float64  `json:"Rows Removed by Join Filter"`
+	SortKey                 []string  `json:"Sort Key"`
+	SortMethod              string    `json:"Sort Method"`
+	GroupKey                []string  `json:"Group Key"`
+	SharedHitBlocks         *int64    `json:"Shared Hit Blocks"`
+	SharedReadBlocks        int64     `json:"Shared Read Blocks"`
+	SharedDirtiedBlocks     int64     `json:"Shared Dirtied Blocks"`
+	SharedWrittenBlocks     int64     `json:"Shared Written Blocks"`
+	TempReadBlocks          int64     `json:"Temp Read Blocks"`
+	TempWrittenBlocks       int64     `json:"Temp Written Blocks"`
+	Plans                   []rawPlan `json:"Plans"`
+}
+
+// rawExplain is the single element of the EXPLAIN (FORMAT JSON) output
+type rawExplain struct {
+	Plan          rawPlan  `json:"Plan"`
+	PlanningTime  *float64 `json:"Planning Time"`
+	ExecutionTime *float64 `json:"Execution Time"`
+}
+
+// Explain shows the plan of a statement with EXPLAIN (FORMAT JSON). With
+// analyze the statement runs in a transaction, or a savepoint of the open
+// one, that is rolled back, so explaining DML leaves the sandbox as it was.
+func (h *Handler) Explain(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID, err := h.getSessionIDFromCookie(r)
+	if err != nil {
+		slog.Error("No session cookie found", "error", err)
+		http.Error(w, "session required", http.StatusUnauthorized)
+		return
+	}
+
+	var req ExplainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode explain request", "error", err)
+		http.Error(w, "bad request", 400)
+		return
+	}
+
+	queryID := req.QueryID
+	if queryID == "" {
+		queryID = newQueryID()
+	} else if !validQueryID.MatchString(queryID) {
+		http.Error(w, "invalid query id", http.StatusBadRequest)
+		return
+	}
+
+	stmts := splitStatements(req.Query)
+	switch {
+	case len(stmts) == 0:
+		http.Error(w, "query is empty", http.StatusBadRequest)
+		return
+	case len(stmts) > 1:
+		http.Error(w, "explain takes a single statement", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.Sandbox.GetOrCreateSession(sessionID, ""); err != nil {
+		slog.Error("Failed to get/create sandbox",
+			"session_id", sessionID,
+			"error", err,
+		)
+		http.Error(w, "sandbox error", 500)
+		return
+	}
+	h.Sandbox.UpdateSessionActivity(sessionID)
+
+	ctx := r.Context()
+	sc, err := h.Sandbox.AcquireConn(ctx, sessionID)
+	if err != nil {
+		slog.Error("Failed to open database connection",
+			"session_id", sessionID,
+			"error", err,
+		)
+		http.Error(w, "db connection failed", 500)
+		return
+	}
+	defer sc.Release()
+
+	if !h.trackQuery(ctx, w, sc.Conn, sessionID, queryID) {
+		return
+	}
+	defer h.queries.unregister(queryID)
+
+	resp := ExplainResponse{
+		QueryID:  queryID,
+		Analyze:  req.Analyze,
+		Buffers:  req.Buffers,
+		Notices:  []Notice{},
+		Stateful: sc.Stateful,
+	}
+	res, err := runExplain(ctx, sc, stmts[0], req.Analyze, req.Buffers)
+	resp.TxStatus = sc.TxStatus(ctx)
+
+	switch {
+	case err != nil:
+		resp.Error = err.Error()
+	case res.Error != "":
+		resp.Error, resp.ErrorDetail = res.Error, res.ErrorDetail
+	default:
+		if err := resp.setPlan(res.Rows); err != nil {
+			slog.Error("Failed to parse plan",
+				"session_id", sessionID,
+				"query_id", queryID,
+				"error", err,
+			)
+			resp.Error = "failed to parse plan"
+		}
+	}
+	resp.Notices = append(resp.Notices, res.Notices...)
+
+	slog.Info("Query explained",
+		"session_id", sessionID,
+		"query_id", queryID,
+		"analyze", req.Analyze,
+		"buffers", req.Buffers,
+		"failed", resp.Error != "",
+		"tx_status", resp.TxStatus,
+		"duration", time.Since(start),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runExplain runs EXPLAIN on a statement. With analyze it wraps it in a
+// transaction that is rolled back, or in a savepoint when the session's
+// own connection is in a transaction already. The returned error is set
+// when the rollback failed; errors of EXPLAIN itself are in the result.
+func runExplain(ctx context.Context, sc *db.SessionConn, stmt statement, analyze, buffers bool) (StatementResult, error) {
+	options := []string{"FORMAT JSON"}
+	if analyze {
+		options = append(options, "ANALYZE")
+	}
+	if buffers {
+		options = append(options, "BUFFERS")
+	}
+	prefix := fmt.Sprintf("EXPLAIN (%s) ", strings.Join(options, ", "))
+
+	explain := stmt.behind(prefix)
+
+	if !analyze {
+		res := runStatement(ctx, sc.Conn, 0, explain, &resultBudget{}, collectRows{})
+		shiftErrorPosition(&res, prefix)
+		return res, nil
+	}
+
+	var begin, rollback []string
+	switch sc.TxStatus(ctx) {
+	case db.TxIdle:
+		begin, rollback = []string{"BEGIN"}, []string{"ROLLBACK"}
+	case db.TxInTransaction:
+		begin = []string{"SAVEPOINT " + explainSavepoint}
+		rollback = []string{"ROLLBACK TO SAVEPOINT " + explainSavepoint, "RELEASE SAVEPOINT " + explainSavepoint}
+	case db.TxFailed:
+		return StatementResult{}, errors.New("the current transaction has failed, run ROLLBACK first")
+	default:
+		return StatementResult{}, errors.New("failed to read the transaction status")
+	}
+
+	for _, q := range begin {
+		if _, err := sc.ExecContext(ctx, q); err != nil {
+			return StatementResult{}, err
+		}
+	}
+	res := runStatement(ctx, sc.Conn, 0, explain, &resultBudget{}, collectRows{})
+	shiftErrorPosition(&res, prefix)
+
+	// The rollback runs even when the client went away, otherwise the
+	// explained changes would stay in the transaction
+	cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), explainCleanupTimeout)
+	defer cancel()
+	for _, q := range rollback {
+		if _, err := sc.ExecContext(cleanupCtx, q); err != nil {
+			// Closing the connection ends its transaction instead
+			sc.Discard()
+			return res, fmt.Errorf("failed to roll back explain: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// setPlan parses the single JSON value EXPLAIN (FORMAT JSON) returns
+func (resp *ExplainResponse) setPlan(rows [][]interface{}) error {
+	if len(rows) != 1 || len(rows[0]) != 1 {
+		return fmt.Errorf("expected one plan, got %d rows", len(rows))
+	}
+
+	var data []byte
+	switch v := rows[0][0].(type) {
+	case json.RawMessage:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unexpected plan type %T", v)
+	}
+
+	var explains []rawExplain
+	if err := json.Unmarshal(data, &explains); err != nil {
+		return err
+	}
+	if len(explains) != 1 {
+		return fmt.Errorf("expected one plan, got %d", len(explains))
+	}
+
+	resp.Plan = explains[0].Plan.node()
+	resp.PlanningMs = explains[0].PlanningTime
+	resp.ExecutionMs = explains[0].ExecutionTime
+	resp.Text = planText(resp.Plan, resp.PlanningMs, resp.ExecutionMs)
+	return nil
+}
+
+// node normalizes a raw plan node and its children
+func (p *rawPlan) node() *PlanNode {
+	n := &PlanNode{
+		NodeType:                p.NodeType,
+		ParentRelationship:      p.ParentRelationship,
+		SubplanName:             p.SubplanName,
+		ParallelAware:           p.ParallelAware,
+		JoinType:                p.JoinType,
+		Strategy:                p.Strategy,
+		Relation:                p.RelationName,
+		Schema:                  p.Schema,
+		Alias:                   p.Alias,
+		Index:                   p.IndexName,
+		CTEName:                 p.CTEName,
+		FunctionName:            p.FunctionName,
+		StartupCost:             p.StartupCost,
+		TotalCost:               p.TotalCost,
+		EstimatedRows:           p.PlanRows,
+		Width:                   p.PlanWidth,
+		ActualStartupMs:         p.ActualStartupTime,
+		ActualTotalMs:           p.ActualTotalTime,
+		ActualRows:              p.ActualRows,
+		Loops:                   p.ActualLoops,
+		Filter:                  p.Filter,
+		RowsRemovedByFilter:     p.RowsRemovedByFilter,
+		IndexCond:               p.IndexCond,
+		RecheckCond:             p.RecheckCond,
+		HashCond:                p.HashCond,
+		MergeCond:               p.MergeCond,
+		JoinFilter:              p.JoinFilter,
+		RowsRemovedByJoinFilter: p.RowsRemovedByJoinFilter,
+		SortKey:                 p.SortKey,
+		SortMethod:              p.SortMethod,
+		GroupKey:                p.GroupKey,
+		Children:                make([]*PlanNode, 0, len(p.Plans)),
+	}
+
+	// Buffer counts are only there with BUFFERS
+	if p.SharedHitBlocks != nil {
+		n.Buffers = &PlanBuffers{
+			SharedHit:     *p.SharedHitBlocks,
+			SharedRead:    p.SharedReadBlocks,
+			SharedDirtied: p.SharedDirtiedBlocks,
+			SharedWritten: p.SharedWrittenBlocks,
+			TempRead:      p.TempReadBlocks,
+			TempWritten:   p.TempWrittenBlocks,
+		}
+	}
+
+	for i := range p.Plans {
+		n.Children = append(n.Children, p.Plans[i].node())
+	}
+	return n
+}
+
+// planText renders a plan the way EXPLAIN does in text format
+func planText(root *PlanNode, planningMs, executionMs *float64) string {
+	var b strings.Builder
+	writePlanNode(&b, root, "", "  ")
+	if planningMs != nil {
+		fmt.Fprintf(&b, "Planning Time: %.3f ms\n", *planningMs)
+	}
+	if executionMs != nil {
+		fmt.Fprintf(&b, "Execution Time: %.3f ms\n", *executionMs)
+	}
+	return b.String()
+}
+
+// writePlanNode writes the line of a node after head, its details indented
+// by indent, and its children below them
+func writePlanNode(b *strings.Builder, n *PlanNode, head, indent string) {
+	fmt.Fprintf(b, "%s%s  (cost=%.2f..%.2f rows=%.0f width=%d)", head, n.label(), n.StartupCost, n.TotalCost, n.EstimatedRows, n.Width)
+	switch {
+	case n.Loops == nil:
+	case *n.Loops == 0:
+		b.WriteString(" (never executed)")
+	case n.ActualStartupMs != nil && n.ActualTotalMs != nil && n.ActualRows != nil:
+		fmt.Fprintf(b, " (actual time=%.3f..%.3f rows=%.0f loops=%d)", *n.ActualStartupMs, *n.ActualTotalMs, *n.ActualRows, *n.Loops)
+	}
+	b.WriteString("\n")
+
+	detail := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(b, "%s%s: %s\n", indent, name, value)
+		}
+	}
+	count := func(name string, value *float64) {
+		if value != nil {
+			detail(name, fmt.Sprintf("%.0f", *value))
+		}
+	}
+	detail("Sort Key", strings.Join(n.SortKey, ", "))
+	detail("Sort Method", n.SortMethod)
+	detail("Group Key", strings.Join(n.GroupKey, ", "))
+	detail("Index Cond", n.IndexCond)
+	detail("Recheck Cond", n.RecheckCond)
+	detail("Hash Cond", n.HashCond)
+	detail("Merge Cond", n.MergeCond)
+	detail("Join Filter", n.JoinFilter)
+	count("Rows Removed by Join Filter", n.RowsRemovedByJoinFilter)
+	detail("Filter", n.Filter)
+	count("Rows Removed by Filter", n.RowsRemovedByFilter)
+	if n.Buffers != nil {
+		detail("Buffers", n.Buffers.String())
+	}
+
+	for _, child := range n.Children {
+		childIndent := indent
+		if child.SubplanName != "" {
+			fmt.Fprintf(b, "%s%s\n", indent, child.SubplanName)
+			childIndent += "  "
+		}
+		writePlanNode(b, child, childIndent+"->  ", childIndent+"      ")
+	}
+}
+
+// label names a node like the text format does, e.g. "Hash Left Join" or
+// "Index Scan using employee_pkey on employee e"
+func (n *PlanNode) label() string {
+	label := n.NodeType
+	switch {
+	case n.NodeType == "Aggregate" && n.Strategy == "Sorted":
+		label = "GroupAggregate"
+	case n.NodeType == "Aggregate" && n.Strategy == "Hashed":
+		label = "HashAggregate"
+	case n.NodeType == "Aggregate" && n.Strategy == "Mixed":
+		label = "MixedAggregate"
+	case n.JoinType != "" && n.JoinType != "Inner":
+		label = strings.TrimSuffix(n.NodeType, " Join") + " " + n.JoinType + " Join"
+	}
+	if n.ParallelAware {
+		label = "Parallel " + label
+	}
+	if n.Index != "" {
+		label += " using " + n.Index
+	}
+
+	target := n.Relation
+	switch {
+	case n.CTEName != "":
+		target = n.CTEName
+	case n.FunctionName != "":
+		target = n.FunctionName
+	}
+	switch {
+	case target != "" && n.Alias != "" && n.Alias != target:
+		label += " on " + target + " " + n.Alias
+	case target != "":
+		label += " on " + target
+	case n.Alias != "":
+		label += " on " + n.Alias
+	}
+	return label
+}
+
+// String lists the non-zero buffer counts like the text format does
+func (b *PlanBuffers) String() string {
+	var parts []string
+	var shared []string
+	for _, c := range []struct {
+		name  string
+		value int64
+	}{{"hit", b.SharedHit}, {"read", b.SharedRead}, {"dirtied", b.SharedDirtied}, {"written", b.SharedWritten}} {
+		if c.value > 0 {
+			shared = append(shared, fmt.Sprintf("%s=%d", c.name, c.value))
+		}
+	}
+	if len(shared) > 0 {
+		parts = append(parts, "shared "+strings.Join(shared, " "))
+	}
+
+	var temp []string
+	if b.TempRead > 0 {
+		temp = append(temp, fmt.Sprintf("read=%d", b.TempRead))
+	}
+	if b.TempWritten > 0 {
+		temp = append(temp, fmt.Sprintf("written=%d", b.TempWritten))
+	}
+	if len(temp) > 0 {
+		parts = append(parts, "temp "+strings.Join(temp, " "))
+	}
+	return strings.Join(parts, ", ")
+}
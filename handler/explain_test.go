@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPlanLabel(t *testing.T) {
+	tests := []struct {
+		node PlanNode
+		want string
+	}{
+		{PlanNode{NodeType: "Seq Scan", Relation: "employee", Alias: "employee"}, "Seq Scan on employee"},
+		{PlanNode{NodeType: "Seq Scan", Relation: "employee", Alias: "e"}, "Seq Scan on employee e"},
+		{PlanNode{NodeType: "Index Scan", Index: "employee_pkey", Relation: "employee", Alias: "e"}, "Index Scan using employee_pkey on employee e"},
+		{PlanNode{NodeType: "Seq Scan", ParallelAware: true, Relation: "t", Alias: "t"}, "Parallel Seq Scan on t"},
+		{PlanNode{NodeType: "Hash Join", JoinType: "Inner"}, "Hash Join"},
+		{PlanNode{NodeType: "Hash Join", JoinType: "Left"}, "Hash Left Join"},
+		{PlanNode{NodeType: "Nested Loop", JoinType: "Anti"}, "Nested Loop Anti Join"},
+		{PlanNode{NodeType: "Aggregate", Strategy: "Plain"}, "Aggregate"},
+		{PlanNode{NodeType: "Aggregate", Strategy: "Sorted"}, "GroupAggregate"},
+		{PlanNode{NodeType: "Aggregate", Strategy: "Hashed"}, "HashAggregate"},
+		{PlanNode{NodeType: "Aggregate", Strategy: "Hashed", ParallelAware: true}, "Parallel HashAggregate"},
+		{PlanNode{NodeType: "CTE Scan", CTEName: "x", Alias: "x"}, "CTE Scan on x"},
+		{PlanNode{NodeType: "Function Scan", FunctionName: "generate_series", Alias: "g"}, "Function Scan on generate_series g"},
+		{PlanNode{NodeType: "Values Scan", Alias: "*VALUES*"}, "Values Scan on *VALUES*"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.node.label(); got != tt.want {
+			t.Errorf("label() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestPlanBuffersString(t *testing.T) {
+	tests := []struct {
+		buffers PlanBuffers
+		want    string
+	}{
+		{PlanBuffers{}, ""},
+		{PlanBuffers{SharedHit: 3}, "shared hit=3"},
+		{PlanBuffers{SharedHit: 3, SharedRead: 2, SharedDirtied: 1}, "shared hit=3 read=2 dirtied=1"},
+		{PlanBuffers{TempRead: 5, TempWritten: 5}, "temp read=5 written=5"},
+		{PlanBuffers{SharedRead: 1, TempWritten: 7}, "shared read=1, temp written=7"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.buffers.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.buffers, got, tt.want)
+		}
+	}
+}
+
+func TestSetPlan(t *testing.T) {
+	tests := []struct {
+		name string
+		plan string
+		want string
+	}{
+		{
+			name: "estimates only",
+			plan: `[{"Plan": {
+				"Node Type": "Seq Scan", "Relation Name": "employee", "Alias": "employee",
+				"Startup Cost": 0.00, "Total Cost": 1.08, "Plan Rows": 8, "Plan Width": 36,
+				"Filter": "(salary > 1000)"
+			}}]`,
+			want: "Seq Scan on employee  (cost=0.00..1.08 rows=8 width=36)\n" +
+				"  Filter: (salary > 1000)\n",
+		},
+		{
+			name: "analyze with children",
+			plan: `[{"Plan": {
+				"Node Type": "Hash Join", "Join Type": "Left",
+				"Startup Cost": 1.09, "Total Cost": 2.23, "Plan Rows": 8, "Plan Width": 64,
+				"Actual Startup Time": 0.030, "Actual Total Time": 0.040, "Actual Rows": 8, "Actual Loops": 1,
+				"Hash Cond": "(e.dept_id = d.id)",
+				"Plans": [
+					{"Node Type": "Seq Scan", "Parent Relationship": "Outer", "Relation Name": "employee", "Alias": "e",
+					 "Startup Cost": 0.00, "Total Cost": 1.08, "Plan Rows": 8, "Plan Width": 36,
+					 "Actual Startup Time": 0.005, "Actual Total Time": 0.007, "Actual Rows": 8, "Actual Loops": 1},
+					{"Node Type": "Hash", "Parent Relationship": "Inner",
+					 "Startup Cost": 1.04, "Total Cost": 1.04, "Plan Rows": 4, "Plan Width": 36,
+					 "Actual Startup Time": 0.010, "Actual Total Time": 0.010, "Actual Rows": 4, "Actual Loops": 1,
+					 "Shared Hit Blocks": 1, "Shared Read Blocks": 0,
+					 "Plans": [
+						{"Node Type": "Seq Scan", "Parent Relationship": "Outer", "Relation Name": "department", "Alias": "d",
+						 "Startup Cost": 0.00, "Total Cost": 1.04, "Plan Rows": 4, "Plan Width": 36,
+						 "Actual Startup Time": 0.003, "Actual Total Time": 0.004, "Actual Rows": 4, "Actual Loops": 1,
+						 "Rows Removed by Filter": 0}
+					 ]}
+				]
+			}, "Planning Time": 0.120, "Execution Time": 0.075}]`,
+			want: "Hash Left Join  (cost=1.09..2.23 rows=8 width=64) (actual time=0.030..0.040 rows=8 loops=1)\n" +
+				"  Hash Cond: (e.dept_id = d.id)\n" +
+				"  ->  Seq Scan on employee e  (cost=0.00..1.08 rows=8 width=36) (actual time=0.005..0.007 rows=8 loops=1)\n" +
+				"  ->  Hash  (cost=1.04..1.04 rows=4 width=36) (actual time=0.010..0.010 rows=4 loops=1)\n" +
+				"        Buffers: shared hit=1\n" +
+				"        ->  Seq Scan on department d  (cost=0.00..1.04 rows=4 width=36) (actual time=0.003..0.004 rows=4 loops=1)\n" +
+				"              Rows Removed by Filter: 0\n" +
+				"Planning Time: 0.120 ms\n" +
+				"Execution Time: 0.075 ms\n",
+		},
+		{
+			name: "subplan never executed",
+			plan: `[{"Plan": {
+				"Node Type": "Result",
+				"Startup Cost": 8.17, "Total Cost": 8.18, "Plan Rows": 1, "Plan Width": 4,
+				"Actual Startup Time": 0.010, "Actual Total Time": 0.011, "Actual Rows": 1, "Actual Loops": 1,
+				"Plans": [
+					{"Node Type": "Index Only Scan", "Parent Relationship": "SubPlan", "Subplan Name": "SubPlan 1",
+					 "Index Name": "t_pkey", "Relation Name": "t", "Alias": "t",
+					 "Startup Cost": 0.15, "Total Cost": 8.17, "Plan Rows": 1, "Plan Width": 4,
+					 "Actual Loops": 0, "Index Cond": "(id = 1)"}
+				]
+			}}]`,
+			want: "Result  (cost=8.17..8.18 rows=1 width=4) (actual time=0.010..0.011 rows=1 loops=1)\n" +
+				"  SubPlan 1\n" +
+				"    ->  Index Only Scan using t_pkey on t  (cost=0.15..8.17 rows=1 width=4) (never executed)\n" +
+				"          Index Cond: (id = 1)\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ExplainResponse
+			if err := resp.setPlan([][]interface{}{{json.RawMessage(tt.plan)}}); err != nil {
+				t.Fatalf("setPlan: %v", err)
+			}
+			if resp.Text != tt.want {
+				t.Errorf("plan text =\n%s\nwant\n%s", resp.Text, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetPlanRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		rows [][]interface{}
+	}{
+		{"no rows", nil},
+		{"two columns", [][]interface{}{{"[]", "[]"}}},
+		{"not json", [][]interface{}{{"Seq Scan on t"}}},
+		{"no plan", [][]interface{}{{"[]"}}},
+		{"unexpected type", [][]interface{}{{int64(1)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ExplainResponse
+			if err := resp.setPlan(tt.rows); err == nil {
+				t.Errorf("setPlan(%v) succeeded, want an error", tt.rows)
+			}
+		})
+	}
+}
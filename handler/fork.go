@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pouyatavakoli/QueryLab/db"
+)
+
+// ForkResponse carries the token others can start a session from
+type ForkResponse struct {
+	Token     string    `json:"fork_token"`
+	Dataset   string    `json:"dataset"`
+	ExpiresAt time.Time `json:"expires_at"`
+	URL       string    `json:"url"` // relative link that redeems the token
+}
+
+// ForkSession freezes the current state of the session's sandbox and
+// returns a shareable fork token
+func (h *Handler) ForkSession(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	sessionID, err := h.getSessionIDFromCookie(r)
+	if err != nil {
+		slog.Error("No session cookie found", "error", err)
+		http.Error(w, "session required", http.StatusUnauthorized)
+		return
+	}
+
+	fork, err := h.Sandbox.CreateFork(sessionID)
+	switch {
+	case errors.Is(err, db.ErrSessionNotFound):
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	case errors.Is(err, db.ErrForkQuota):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		slog.Error("Failed to fork session",
+			"session_id", sessionID,
+			"error", err,
+		)
+		http.Error(w, "fork failed", 500)
+		return
+	}
+
+	slog.Info("Session forked",
+		"session_id", sessionID,
+		"expires_at", fork.ExpiresAt,
+		"duration", time.Since(start),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ForkResponse{
+		Token:     fork.Token,
+		Dataset:   fork.DatasetID,
+		ExpiresAt: fork.ExpiresAt,
+		URL:       "/?fork=" + url.QueryEscape(fork.Token),
+	})
+}
+
+// createForkedSession creates a new session from a fork token. It replaces
+// the session of the cookie, whose sandbox is dropped.
+func (h *Handler) createForkedSession(w http.ResponseWriter, r *http.Request, token string, start time.Time) {
+	id := h.Sandbox.GenerateSessionID()
+	slog.Info("Creating session from fork", "session_id", id)
+
+	dbName, err := h.Sandbox.CreateSessionFromFork(id, token)
+	if errors.Is(err, db.ErrForkNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to create sandbox from fork", "session_id", id, "error", err)
+		http.Error(w, "sandbox creation failed", 500)
+		return
+	}
+
+	if oldID, err := h.getSessionIDFromCookie(r); err == nil {
+		if err := h.Sandbox.CleanupSession(oldID); err != nil {
+			slog.Warn("Failed to cleanup replaced session",
+				"session_id", oldID,
+				"error", err,
+			)
+		}
+	}
+
+	h.setSessionCookie(w, id)
+
+	slog.Info("Session created from fork",
+		"session_id", id,
+		"db_name", dbName,
+		"duration", time.Since(start),
+	)
+
+	h.writeSession(w, id)
+}
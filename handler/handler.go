@@ -1,9 +1,9 @@
 package handler
 
 import (
-	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"time"
@@ -14,28 +14,76 @@ import (
 
 type Handler struct {
 	Sandbox *db.SandboxManager
+	Options Options
+
+	queries *queryRegistry
 }
 
-func NewHandler(s *db.SandboxManager) *Handler {
-	slog.Info("Creating new handler", "sandbox_manager", true)
-	return &Handler{Sandbox: s}
+// Options limits the results returned by RunQuery
+type Options struct {
+	MaxRows  int   // Rows returned per statement, 0 for no limit
+	MaxBytes int64 // Size of the JSON row data of a response, 0 for no limit
+}
+
+func NewHandler(s *db.SandboxManager, opts Options) *Handler {
+	slog.Info("Creating new handler",
+		"sandbox_manager", true,
+		"max_rows", opts.MaxRows,
+		"max_bytes", opts.MaxBytes,
+	)
+	return &Handler{Sandbox: s, Options: opts, queries: newQueryRegistry()}
 }
 
 type QueryRequest struct {
-	Query string `json:"query"` // Removed SessionID from request - now from cookie
+	Query   string `json:"query"`    // Removed SessionID from request - now from cookie
+	QueryID string `json:"query_id"` // Optional, lets the client cancel the query while it runs
 }
 
+// QueryResponse holds the results of every statement that ran, in order.
+// The other fields repeat the result of the last one.
 type QueryResponse struct {
-	Columns []string        `json:"columns"`
-	Rows    [][]interface{} `json:"rows"`
-	Error   string          `json:"error,omitempty"`
+	QueryID       string            `json:"query_id"`
+	StatementType string            `json:"statement_type,omitempty"`
+	CommandTag    string            `json:"command_tag,omitempty"`
+	RowsAffected  int64             `json:"rows_affected"`
+	Columns       []Column          `json:"columns"`
+	Rows          [][]interface{}   `json:"rows"`
+	Truncated     bool              `json:"truncated,omitempty"`
+	LimitType     string            `json:"limit_type,omitempty"`
+	Limit         int64             `json:"limit,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	ErrorDetail   *QueryError       `json:"error_detail,omitempty"`
+	Results       []StatementResult `json:"results"`
+
+	// Notices collects the notices of every statement in the order the
+	// server sent them; each one names the statement it came from
+	Notices []Notice `json:"notices"`
+
+	// Stateful reports whether the query ran on the session's own
+	// connection. TxStatus is idle, in transaction or failed after the
+	// last statement; without stateful mode an open transaction is rolled
+	// back when the request ends.
+	Stateful bool   `json:"stateful"`
+	TxStatus string `json:"transaction_status,omitempty"`
+}
+
+type SessionRequest struct {
+	Dataset string `json:"dataset"` // Optional, switches the session to this dataset
+	Fork    string `json:"fork"`    // Optional, starts a new session from a fork token
 }
 
 type SessionResponse struct {
 	SessionID string `json:"session_id"`
+	Dataset   string `json:"dataset"`
+	Stateful  bool   `json:"stateful"`
 	Success   bool   `json:"success"`
 }
 
+// StatefulRequest switches stateful mode for the session
+type StatefulRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
 // getSessionIDFromCookie extracts session ID from cookies
 func (h *Handler) getSessionIDFromCookie(r *http.Request) (string, error) {
 	cookie, err := r.Cookie("querylab_session")
@@ -73,21 +121,48 @@ func (h *Handler) clearSessionCookie(w http.ResponseWriter) {
 func (h *Handler) CreateSession(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
+	var req SessionRequest
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			slog.Error("Failed to decode session request", "error", err)
+			http.Error(w, "bad request", 400)
+			return
+		}
+	}
+	if req.Dataset == "" {
+		req.Dataset = r.URL.Query().Get("dataset")
+	}
+	if req.Fork == "" {
+		req.Fork = r.URL.Query().Get("fork")
+	}
+
+	if req.Fork != "" {
+		h.createForkedSession(w, r, req.Fork, start)
+		return
+	}
+
+	if _, err := h.Sandbox.Datasets().Get(req.Dataset); err != nil {
+		slog.Warn("Unknown dataset requested", "dataset", req.Dataset)
+		http.Error(w, "unknown dataset", http.StatusBadRequest)
+		return
+	}
+
 	// Check if session already exists in cookie
 	if existingSessionID, err := h.getSessionIDFromCookie(r); err == nil {
 		slog.Info("Found existing session in cookie, refreshing",
 			"session_id", existingSessionID,
+			"dataset", req.Dataset,
 		)
 
-		// Clean up old sandbox and create new one
-		dbName, err := h.Sandbox.GetOrCreateSession(existingSessionID)
+		// Reuse the sandbox, or re-provision it if another dataset was chosen
+		dbName, err := h.Sandbox.GetOrCreateSession(existingSessionID, req.Dataset)
 		if err != nil {
 			slog.Error("Failed to refresh sandbox",
 				"session_id", existingSessionID,
 				"error", err,
 			)
 			// Generate new session if refresh fails
-			h.createNewSession(w, start)
+			h.createNewSession(w, req.Dataset, start)
 			return
 		}
 
@@ -99,23 +174,20 @@ func (h *Handler) CreateSession(w http.ResponseWriter, r *http.Request) {
 
 		// Refresh cookie
 		h.setSessionCookie(w, existingSessionID)
-		json.NewEncoder(w).Encode(SessionResponse{
-			SessionID: existingSessionID,
-			Success:   true,
-		})
+		h.writeSession(w, existingSessionID)
 		return
 	}
 
 	// No existing session, create new one
-	h.createNewSession(w, start)
+	h.createNewSession(w, req.Dataset, start)
 }
 
 // createNewSession creates a brand new session
-func (h *Handler) createNewSession(w http.ResponseWriter, start time.Time) {
+func (h *Handler) createNewSession(w http.ResponseWriter, datasetID string, start time.Time) {
 	id := h.Sandbox.GenerateSessionID()
-	slog.Info("Creating new session", "session_id", id)
+	slog.Info("Creating new session", "session_id", id, "dataset", datasetID)
 
-	dbName, err := h.Sandbox.GetOrCreateSession(id)
+	dbName, err := h.Sandbox.GetOrCreateSession(id, datasetID)
 	if err != nil {
 		slog.Error("Failed to create sandbox", "session_id", id, "error", err)
 		http.Error(w, "sandbox creation failed", 500)
@@ -131,12 +203,96 @@ func (h *Handler) createNewSession(w http.ResponseWriter, start time.Time) {
 		"duration", time.Since(start),
 	)
 
+	h.writeSession(w, id)
+}
+
+// ResetSession replaces the session's sandbox with a fresh copy of its
+// dataset. The session ID and cookie stay the same.
+func (h *Handler) ResetSession(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	sessionID, err := h.getSessionIDFromCookie(r)
+	if err != nil {
+		slog.Error("No session cookie found", "error", err)
+		http.Error(w, "session required", http.StatusUnauthorized)
+		return
+	}
+
+	dbName, err := h.Sandbox.ResetSession(sessionID)
+	if errors.Is(err, db.ErrSessionNotFound) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to reset sandbox",
+			"session_id", sessionID,
+			"error", err,
+		)
+		http.Error(w, "sandbox reset failed", 500)
+		return
+	}
+
+	slog.Info("Session reset successfully",
+		"session_id", sessionID,
+		"db_name", dbName,
+		"duration", time.Since(start),
+	)
+
+	h.setSessionCookie(w, sessionID)
+	h.writeSession(w, sessionID)
+}
+
+// SetStateful switches the session in or out of stateful mode, where its
+// queries share one connection across requests. GET reports the mode.
+func (h *Handler) SetStateful(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := h.getSessionIDFromCookie(r)
+	if err != nil {
+		slog.Error("No session cookie found", "error", err)
+		http.Error(w, "session required", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		var req StatefulRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			slog.Error("Failed to decode stateful request", "error", err)
+			http.Error(w, "bad request", 400)
+			return
+		}
+
+		if err := h.Sandbox.SetStateful(sessionID, req.Enabled); err != nil {
+			if errors.Is(err, db.ErrSessionNotFound) {
+				http.Error(w, "session not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to switch stateful mode", "session_id", sessionID, "error", err)
+			http.Error(w, "stateful mode switch failed", 500)
+			return
+		}
+		slog.Info("Stateful mode switched", "session_id", sessionID, "enabled", req.Enabled)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatefulRequest{Enabled: h.Sandbox.Stateful(sessionID)})
+}
+
+// writeSession writes the session response
+func (h *Handler) writeSession(w http.ResponseWriter, sessionID string) {
+	dataset, _ := h.Sandbox.GetDataset(sessionID)
 	json.NewEncoder(w).Encode(SessionResponse{
-		SessionID: id,
+		SessionID: sessionID,
+		Dataset:   dataset,
+		Stateful:  h.Sandbox.Stateful(sessionID),
 		Success:   true,
 	})
 }
 
+// ListDatasets returns the datasets a session can be created from
+func (h *Handler) ListDatasets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Sandbox.Datasets().List())
+}
+
 func (h *Handler) RunQuery(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
@@ -155,13 +311,22 @@ func (h *Handler) RunQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	queryID := req.QueryID
+	if queryID == "" {
+		queryID = newQueryID()
+	} else if !validQueryID.MatchString(queryID) {
+		http.Error(w, "invalid query id", http.StatusBadRequest)
+		return
+	}
+
 	slog.Info("Running query",
 		"session_id", sessionID,
+		"query_id", queryID,
 		"query_length", len(req.Query),
 	)
 
 	// Get or create sandbox for this session
-	dbName, err := h.Sandbox.GetOrCreateSession(sessionID)
+	dbName, err := h.Sandbox.GetOrCreateSession(sessionID, "")
 	if err != nil {
 		slog.Error("Failed to get/create sandbox",
 			"session_id", sessionID,
@@ -179,24 +344,14 @@ func (h *Handler) RunQuery(w http.ResponseWriter, r *http.Request) {
 		"db_name", dbName,
 	)
 
-	cfg := h.Sandbox.Config()
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		cfg.Host,
-		cfg.Port,
-		cfg.SandboxUser,
-		cfg.SandboxPassword,
-		dbName,
-	)
-
-	slog.Debug("Connecting to database",
-		"host", cfg.Host,
-		"port", cfg.Port,
-		"dbname", dbName,
-		"user", cfg.SandboxUser,
-	)
-
-	dbConn, err := sql.Open("postgres", connStr)
+	// Run every statement on the same connection so session state such as
+	// temp tables and SET carries over from one statement to the next.
+	// In stateful mode that is the session's own connection, which keeps
+	// the state for the next request; otherwise it comes from the
+	// sandbox's pool and is reset before the next request gets it.
+	// The request context cancels the running statement if the client goes away.
+	ctx := r.Context()
+	sc, err := h.Sandbox.AcquireConn(ctx, sessionID)
 	if err != nil {
 		slog.Error("Failed to open database connection",
 			"session_id", sessionID,
@@ -205,68 +360,62 @@ func (h *Handler) RunQuery(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "db connection failed", 500)
 		return
 	}
-	defer dbConn.Close()
+	defer sc.Release()
+	conn := sc.Conn
 
-	rows, err := dbConn.Query(req.Query)
-	if err != nil {
-		slog.Error("Query execution failed",
-			"session_id", sessionID,
-			"query", req.Query,
-			"error", err,
-		)
-		json.NewEncoder(w).Encode(QueryResponse{Error: err.Error()})
+	if !h.trackQuery(ctx, w, conn, sessionID, queryID) {
 		return
 	}
-	defer rows.Close()
-
-	cols, _ := rows.Columns()
-	slog.Debug("Query executed successfully",
-		"session_id", sessionID,
-		"num_columns", len(cols),
-	)
+	defer h.queries.unregister(queryID)
 
-	var out [][]interface{}
-	rowCount := 0
-
-	for rows.Next() {
-	row := make([]interface{}, len(cols))
-	ptrs := make([]interface{}, len(cols))
-
-	for i := range row {
-		ptrs[i] = &row[i]
+	stmts := splitStatements(req.Query)
+	if wantsStream(r) {
+		h.streamQuery(ctx, w, sc, stmts, sessionID, queryID, start)
+		return
 	}
-
-	if err := rows.Scan(ptrs...); err != nil {
-		slog.Error("Row scan failed", "error", err)
-		continue
+	if len(stmts) == 0 {
+		json.NewEncoder(w).Encode(QueryResponse{
+			QueryID:  queryID,
+			Error:    "query is empty",
+			Results:  []StatementResult{},
+			Notices:  []Notice{},
+			Stateful: sc.Stateful,
+			TxStatus: sc.TxStatus(ctx),
+		})
+		return
 	}
 
-	// Normalize types for JSON
-	for i, v := range row {
-		switch val := v.(type) {
-		case []byte:
-			row[i] = string(val)
-		default:
-			row[i] = val
-		}
-	}
+	resp := QueryResponse{QueryID: queryID, Stateful: sc.Stateful}
+	resp.Results, _ = runScript(ctx, conn, stmts, newResultBudget(h.Options), collectRows{}, sessionID)
+	resp.TxStatus = sc.TxStatus(ctx)
 
-	out = append(out, row)
-	rowCount++
-}
+	resp.Notices = []Notice{}
+	for _, res := range resp.Results {
+		resp.Notices = append(resp.Notices, res.Notices...)
+	}
 
+	// The top-level fields mirror the last statement that ran
+	last := resp.Results[len(resp.Results)-1]
+	resp.Columns, resp.Rows, resp.Error, resp.ErrorDetail = last.Columns, last.Rows, last.Error, last.ErrorDetail
+	resp.StatementType, resp.CommandTag, resp.RowsAffected = last.StatementType, last.CommandTag, last.RowsAffected
+	resp.Truncated, resp.LimitType, resp.Limit = last.Truncated, last.LimitType, last.Limit
 
 	slog.Info("Query completed",
 		"session_id", sessionID,
-		"num_rows", rowCount,
-		"num_columns", len(cols),
+		"query_id", queryID,
+		"num_statements", len(resp.Results),
+		"num_notices", len(resp.Notices),
+		"command_tag", last.CommandTag,
+		"rows_affected", last.RowsAffected,
+		"num_rows", len(last.Rows),
+		"num_columns", len(last.Columns),
+		"truncated", last.Truncated,
+		"stateful", resp.Stateful,
+		"tx_status", resp.TxStatus,
 		"duration", time.Since(start),
 	)
 
-	json.NewEncoder(w).Encode(QueryResponse{
-		Columns: cols,
-		Rows:    out,
-	})
+	json.NewEncoder(w).Encode(resp)
 }
 
 // Logout handles session termination
@@ -297,8 +446,84 @@ func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":  "healthy",
-		"time":    time.Now().Format(time.RFC3339),
-		"service": "QueryLab",
+		"status":      "healthy",
+		"time":        time.Now().Format(time.RFC3339),
+		"service":     "QueryLab",
+		"pool":        h.Sandbox.PoolStats(),
+		"connections": h.Sandbox.ConnStats(),
+		"reconciler":  h.Sandbox.ReconcileStats(),
 	})
 }
+
+// GetSchema describes the tables of the session's sandbox database
+func (h *Handler) GetSchema(w http.ResponseWriter, r *http.Request) {
+	schema, ok := h.describeSession(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schema)
+}
+
+// GetSchemaDiagram renders an ER diagram of the session's sandbox database.
+// The format query parameter selects svg (default), dot or mermaid.
+func (h *Handler) GetSchemaDiagram(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "svg"
+	}
+	if format != "svg" && format != "dot" && format != "mermaid" {
+		http.Error(w, "format must be svg, dot or mermaid", http.StatusBadRequest)
+		return
+	}
+
+	schema, ok := h.describeSession(w, r)
+	if !ok {
+		return
+	}
+
+	switch format {
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		io.WriteString(w, schema.SVG())
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		io.WriteString(w, schema.DOT())
+	case "mermaid":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, schema.Mermaid())
+	}
+}
+
+// describeSession reads the schema of the session's sandbox, writing an
+// error response and returning false on failure
+func (h *Handler) describeSession(w http.ResponseWriter, r *http.Request) (*db.Schema, bool) {
+	sessionID, err := h.getSessionIDFromCookie(r)
+	if err != nil {
+		slog.Error("No session cookie found", "error", err)
+		http.Error(w, "session required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if _, err := h.Sandbox.GetOrCreateSession(sessionID, ""); err != nil {
+		slog.Error("Failed to get/create sandbox",
+			"session_id", sessionID,
+			"error", err,
+		)
+		http.Error(w, "sandbox error", 500)
+		return nil, false
+	}
+	h.Sandbox.UpdateSessionActivity(sessionID)
+
+	schema, err := h.Sandbox.DescribeSchema(r.Context(), sessionID)
+	if err != nil {
+		slog.Error("Failed to describe schema",
+			"session_id", sessionID,
+			"error", err,
+		)
+		http.Error(w, "schema introspection failed", 500)
+		return nil, false
+	}
+	return schema, true
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pouyatavakoli/QueryLab/db"
+)
+
+// Result columns report whether the table column they come from allows
+// NULL. The statement is described before it runs, which names the table
+// and column of every result column, and pg_attribute has the rest. A
+// column of a table on the nullable side of an outer join can still be
+// NULL when its table column is NOT NULL.
+
+// originConn is implemented by the sandbox connections, which keep the
+// table columns the columns of the last described statement come from
+type originConn interface {
+	RowOrigins() []db.ColumnOrigin
+}
+
+// describable reports whether a statement may return rows read from table
+// columns
+func describable(text string) bool {
+	switch strings.ToUpper(firstKeyword(text)) {
+	case "SELECT", "TABLE", "WITH":
+		return true
+	case "INSERT", "UPDATE", "DELETE", "MERGE":
+		return strings.Contains(strings.ToUpper(text), "RETURNING")
+	}
+	return false
+}
+
+// columnNullability describes a statement without running it and looks up
+// the nullability of its result columns. Computed columns get nil. An
+// error is the error the statement itself fails with, e.g. a syntax error.
+func columnNullability(ctx context.Context, dc any, text string) ([]*bool, error) {
+	oc, ok := dc.(originConn)
+	if !ok {
+		return nil, nil
+	}
+	preparer, ok := dc.(driver.ConnPrepareContext)
+	if !ok {
+		return nil, nil
+	}
+	queryer, ok := dc.(driver.QueryerContext)
+	if !ok {
+		return nil, nil
+	}
+
+	ps, err := preparer.PrepareContext(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	origins := oc.RowOrigins()
+	if err := ps.Close(); err != nil {
+		return nil, err
+	}
+
+	var pairs []string
+	for _, o := range origins {
+		if o.Table != 0 {
+			pairs = append(pairs, fmt.Sprintf("(%d, %d)", o.Table, o.Column))
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	rows, err := queryer.QueryContext(ctx, `
+		SELECT attrelid::int8, attnum::int8, attnotnull
+		FROM pg_attribute
+		WHERE (attrelid, attnum) IN (`+strings.Join(pairs, ", ")+`)`, nil)
+	if err != nil {
+		return nil, err
+	}
+	notNull := make(map[db.ColumnOrigin]bool)
+	dest := make([]driver.Value, 3)
+	for {
+		if err = rows.Next(dest); err != nil {
+			break
+		}
+		table, _ := dest[0].(int64)
+		column, _ := dest[1].(int64)
+		notNull[db.ColumnOrigin{Table: uint32(table), Column: int16(column)}], _ = dest[2].(bool)
+	}
+	if cerr := rows.Close(); err == io.EOF {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return nullableColumns(origins, notNull), nil
+}
+
+// nullableColumns gives each result column the nullability of the table
+// column it comes from
+func nullableColumns(origins []db.ColumnOrigin, notNull map[db.ColumnOrigin]bool) []*bool {
+	nullable := make([]*bool, len(origins))
+	for i, o := range origins {
+		if nn, ok := notNull[o]; ok {
+			v := !nn
+			nullable[i] = &v
+		}
+	}
+	return nullable
+}
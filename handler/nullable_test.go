@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/pouyatavakoli/QueryLab/db"
+)
+
+func TestNullableColumns(t *testing.T) {
+	table := uint32(16384)
+	origins := []db.ColumnOrigin{
+		{Table: table, Column: 1},
+		{},
+		{Table: table, Column: 2},
+		{Table: table, Column: 3},
+	}
+	notNull := map[db.ColumnOrigin]bool{
+		{Table: table, Column: 1}: true,
+		{Table: table, Column: 2}: false,
+	}
+
+	got := nullableColumns(origins, notNull)
+	want := []string{"false", "unset", "true", "unset"}
+	if len(got) != len(want) {
+		t.Fatalf("nullableColumns() has %d columns, want %d", len(got), len(want))
+	}
+	for i, v := range got {
+		s := "unset"
+		if v != nil {
+			s = strconv.FormatBool(*v)
+		}
+		if s != want[i] {
+			t.Errorf("column %d nullable = %s, want %s", i, s, want[i])
+		}
+	}
+}
+
+func TestDescribable(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"SELECT * FROM employee", true},
+		{"(select 1)", true},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", true},
+		{"TABLE employee", true},
+		{"VALUES (1)", false},
+		{"INSERT INTO t VALUES (1) RETURNING id", true},
+		{"update t set a = 1 returning *", true},
+		{"DELETE FROM t", false},
+		{"CREATE TABLE t (id int)", false},
+		{"EXPLAIN SELECT 1", false},
+	}
+	for _, tt := range tests {
+		if got := describable(tt.text); got != tt.want {
+			t.Errorf("describable(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pouyatavakoli/QueryLab/db"
+)
+
+// SnapshotRequest names a snapshot to create or restore
+type SnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+// SnapshotsResponse lists the snapshots of a session
+type SnapshotsResponse struct {
+	Snapshots []db.Snapshot `json:"snapshots"`
+	Max       int           `json:"max"`
+}
+
+// Snapshots lists (GET), creates (POST) and deletes (DELETE ?name=) the
+// snapshots of the session's sandbox
+func (h *Handler) Snapshots(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := h.getSessionIDFromCookie(r)
+	if err != nil {
+		slog.Error("No session cookie found", "error", err)
+		http.Error(w, "session required", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.writeSnapshots(w, sessionID)
+
+	case http.MethodPost:
+		var req SnapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			slog.Error("Failed to decode snapshot request", "error", err)
+			http.Error(w, "bad request", 400)
+			return
+		}
+
+		start := time.Now()
+		snap, err := h.Sandbox.CreateSnapshot(sessionID, req.Name)
+		if err != nil {
+			writeSnapshotError(w, sessionID, "create", err)
+			return
+		}
+		slog.Info("Snapshot created",
+			"session_id", sessionID,
+			"name", snap.Name,
+			"duration", time.Since(start),
+		)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(snap)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if err := h.Sandbox.DeleteSnapshot(sessionID, name); err != nil {
+			writeSnapshotError(w, sessionID, "delete", err)
+			return
+		}
+		h.writeSnapshots(w, sessionID)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RestoreSnapshot replaces the session's sandbox with one of its snapshots
+func (h *Handler) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := h.getSessionIDFromCookie(r)
+	if err != nil {
+		slog.Error("No session cookie found", "error", err)
+		http.Error(w, "session required", http.StatusUnauthorized)
+		return
+	}
+
+	var req SnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode snapshot request", "error", err)
+		http.Error(w, "bad request", 400)
+		return
+	}
+
+	start := time.Now()
+	if err := h.Sandbox.RestoreSnapshot(sessionID, req.Name); err != nil {
+		writeSnapshotError(w, sessionID, "restore", err)
+		return
+	}
+	slog.Info("Snapshot restored",
+		"session_id", sessionID,
+		"name", req.Name,
+		"duration", time.Since(start),
+	)
+
+	h.writeSnapshots(w, sessionID)
+}
+
+func (h *Handler) writeSnapshots(w http.ResponseWriter, sessionID string) {
+	snaps, err := h.Sandbox.ListSnapshots(sessionID)
+	if err != nil {
+		writeSnapshotError(w, sessionID, "list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SnapshotsResponse{
+		Snapshots: snaps,
+		Max:       h.Sandbox.MaxSnapshots(),
+	})
+}
+
+// writeSnapshotError maps snapshot errors to status codes
+func writeSnapshotError(w http.ResponseWriter, sessionID, op string, err error) {
+	switch {
+	case errors.Is(err, db.ErrSessionNotFound):
+		http.Error(w, "session not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrSnapshotNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, db.ErrSnapshotExists), errors.Is(err, db.ErrSnapshotQuota):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, db.ErrSnapshotName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		slog.Error("Snapshot operation failed",
+			"session_id", sessionID,
+			"op", op,
+			"error", err,
+		)
+		http.Error(w, "snapshot "+op+" failed", 500)
+	}
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// statement is one SQL statement of a script
+type statement struct {
+	Text   string
+	Offset int // byte offset of Text in the script
+	Line   int // 1-based line of Text in the script
+	Column int // 1-based column (in characters) of Text in the script
+}
+
+// splitStatements splits a script into statements on top-level semicolons.
+// Semicolons inside string literals, quoted identifiers, dollar-quoted
+// strings, comments and BEGIN ATOMIC function bodies don't end a statement.
+// Statements holding nothing but whitespace and comments are dropped.
+func splitStatements(script string) []statement {
+	var out []statement
+
+	start := 0
+	hasCode := false // current statement has something besides comments
+
+	// Keyword tracking for CREATE FUNCTION ... BEGIN ATOMIC ... END bodies
+	var words []string
+	blockDepth := 0
+
+	emit := func(end int) {
+		if hasCode {
+			text := script[start:end]
+			trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+			offset := start + len(text) - len(trimmed)
+			line, col := lineColumn(script, offset)
+			out = append(out, statement{
+				Text:   strings.TrimRightFunc(trimmed, unicode.IsSpace),
+				Offset: offset,
+				Line:   line,
+				Column: col,
+			})
+		}
+		hasCode = false
+		words = words[:0]
+		blockDepth = 0
+	}
+
+	for i := 0; i < len(script); {
+		c := script[i]
+
+		switch {
+		case c == '-' && i+1 < len(script) && script[i+1] == '-':
+			// Line comment
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end + 1
+			}
+
+		case c == '/' && i+1 < len(script) && script[i+1] == '*':
+			// Block comment, these nest in PostgreSQL
+			depth := 1
+			i += 2
+			for i < len(script) && depth > 0 {
+				if strings.HasPrefix(script[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(script[i:], "*/") {
+					depth--
+					i += 2
+				} else {
+					i++
+				}
+			}
+
+		case c == '\'':
+			// String literal, E'' strings also allow backslash escapes
+			escapes := i > 0 && (script[i-1] == 'E' || script[i-1] == 'e') &&
+				(i < 2 || !isIdentChar(script[i-2]))
+			hasCode = true
+			i = skipQuoted(script, i, '\'', escapes)
+
+		case c == '"':
+			hasCode = true
+			i = skipQuoted(script, i, '"', false)
+
+		case c == '$' && (i == 0 || !isIdentChar(script[i-1])):
+			hasCode = true
+			if tag, ok := dollarTag(script[i:]); ok {
+				end := strings.Index(script[i+len(tag):], tag)
+				if end < 0 {
+					i = len(script)
+				} else {
+					i += len(tag) + end + len(tag)
+				}
+			} else {
+				i++
+			}
+
+		case c == ';':
+			if blockDepth > 0 {
+				i++
+				continue
+			}
+			emit(i)
+			i++
+			start = i
+
+		case isIdentStart(c):
+			hasCode = true
+			j := i + 1
+			for j < len(script) && isIdentChar(script[j]) {
+				j++
+			}
+			word := strings.ToUpper(script[i:j])
+			words = append(words, word)
+			blockDepth = trackBlock(words, blockDepth)
+			i = j
+
+		default:
+			if !unicode.IsSpace(rune(c)) {
+				hasCode = true
+			}
+			i++
+		}
+	}
+	emit(len(script))
+
+	return out
+}
+
+// trackBlock updates the BEGIN ATOMIC nesting depth after a new keyword.
+// Only CREATE [OR REPLACE] FUNCTION/PROCEDURE statements can have such bodies.
+func trackBlock(words []string, depth int) int {
+	if !isRoutineDefinition(words) {
+		return depth
+	}
+
+	switch words[len(words)-1] {
+	case "ATOMIC":
+		if len(words) > 1 && words[len(words)-2] == "BEGIN" {
+			return depth + 1
+		}
+	case "CASE":
+		if depth > 0 {
+			return depth + 1
+		}
+	case "END":
+		if depth > 0 {
+			return depth - 1
+		}
+	}
+	return depth
+}
+
+func isRoutineDefinition(words []string) bool {
+	if len(words) < 2 || words[0] != "CREATE" {
+		return false
+	}
+	kind := words[1]
+	if kind == "OR" && len(words) >= 4 {
+		kind = words[3]
+	}
+	return kind == "FUNCTION" || kind == "PROCEDURE"
+}
+
+// skipQuoted returns the index just past the quoted token starting at i.
+// A doubled quote character is an escaped quote.
+func skipQuoted(s string, i int, quote byte, backslashEscapes bool) int {
+	i++
+	for i < len(s) {
+		switch {
+		case backslashEscapes && s[i] == '\\':
+			i += 2
+		case s[i] == quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return len(s)
+}
+
+// dollarTag returns the $tag$ opening a dollar-quoted string at the start of s
+func dollarTag(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '$' {
+		return "", false
+	}
+	if s[1] == '$' {
+		return "$$", true
+	}
+	if !isIdentStart(s[1]) {
+		return "", false
+	}
+	for j := 2; j < len(s); j++ {
+		if s[j] == '$' {
+			return s[:j+1], true
+		}
+		if !isIdentChar(s[j]) {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '$'
+}
+
+// lineColumn returns the 1-based line and character column of a byte
+// offset in s
+func lineColumn(s string, offset int) (int, int) {
+	before := s[:offset]
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	return strings.Count(before, "\n") + 1, utf8.RuneCountInString(before[lineStart:]) + 1
+}
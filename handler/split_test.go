@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"empty", "", nil},
+		{"single without semicolon", "SELECT 1", []string{"SELECT 1"}},
+		{"several", "SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"empty statements", "SELECT 1;;  ;", []string{"SELECT 1"}},
+		{"comments only", "-- nothing here;\n/* nor; here */ ;", nil},
+		{"semicolon in string", "SELECT 'a;b'; SELECT 2", []string{"SELECT 'a;b'", "SELECT 2"}},
+		{"doubled quote", "SELECT 'it''s;'; SELECT 2", []string{"SELECT 'it''s;'", "SELECT 2"}},
+		{"backslash in standard string", `SELECT 'a\'; SELECT 2`, []string{`SELECT 'a\'`, "SELECT 2"}},
+		{"escaped quote in E string", `SELECT E'a\';b'; SELECT 2`, []string{`SELECT E'a\';b'`, "SELECT 2"}},
+		{"lowercase e string", `SELECT e'\';'; SELECT 2`, []string{`SELECT e'\';'`, "SELECT 2"}},
+		{"identifier ending in e", `SELECT name'x;' FROM t; SELECT 2`, []string{`SELECT name'x;' FROM t`, "SELECT 2"}},
+		{"quoted identifier", `SELECT "a;""b" FROM t; SELECT 2`, []string{`SELECT "a;""b" FROM t`, "SELECT 2"}},
+		{"line comment", "SELECT 1 -- not; the end\n; SELECT 2", []string{"SELECT 1 -- not; the end", "SELECT 2"}},
+		{"nested block comment", "SELECT 1 /* a /* b; */ c; */; SELECT 2", []string{"SELECT 1 /* a /* b; */ c; */", "SELECT 2"}},
+		{"dollar quote", "DO $$ BEGIN RAISE NOTICE 'x;'; END $$; SELECT 2", []string{"DO $$ BEGIN RAISE NOTICE 'x;'; END $$", "SELECT 2"}},
+		{"tagged dollar quote", "SELECT $fn$ a $$; b $fn$; SELECT 2", []string{"SELECT $fn$ a $$; b $fn$", "SELECT 2"}},
+		{"parameter is no dollar quote", "SELECT $1; SELECT 2", []string{"SELECT $1", "SELECT 2"}},
+		{"dollar inside identifier", "SELECT a$b$c; SELECT 2", []string{"SELECT a$b$c", "SELECT 2"}},
+		{"unterminated string", "SELECT 'a; SELECT 2", []string{"SELECT 'a; SELECT 2"}},
+		{
+			"begin atomic body",
+			"CREATE FUNCTION f() RETURNS int LANGUAGE sql BEGIN ATOMIC SELECT 1; SELECT CASE WHEN true THEN 1 END; END; SELECT f()",
+			[]string{"CREATE FUNCTION f() RETURNS int LANGUAGE sql BEGIN ATOMIC SELECT 1; SELECT CASE WHEN true THEN 1 END; END", "SELECT f()"},
+		},
+		{
+			"or replace procedure",
+			"create or replace procedure p() begin atomic insert into t values (1); end; CALL p()",
+			[]string{"create or replace procedure p() begin atomic insert into t values (1); end", "CALL p()"},
+		},
+		{"transaction block", "BEGIN; SELECT 1; END;", []string{"BEGIN", "SELECT 1", "END"}},
+		{"case outside a function", "SELECT CASE WHEN true THEN 1 END; SELECT 2", []string{"SELECT CASE WHEN true THEN 1 END", "SELECT 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, stmt := range splitStatements(tt.script) {
+				got = append(got, stmt.Text)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.script, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitStatementsPosition(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		index  int
+		offset int
+		line   int
+		column int
+	}{
+		{"first", "SELECT 1", 0, 0, 1, 1},
+		{"leading whitespace", "\n\n   SELECT 1", 0, 5, 3, 4},
+		{"second line", "SELECT 1;\n  SELECT 2", 1, 12, 2, 3},
+		{"same line", "SELECT 1; SELECT 2", 1, 10, 1, 11},
+		{"after multibyte", "SELECT 'é'; SELECT 2", 1, 13, 1, 13},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmts := splitStatements(tt.script)
+			if len(stmts) <= tt.index {
+				t.Fatalf("splitStatements(%q) returned %d statements", tt.script, len(stmts))
+			}
+			stmt := stmts[tt.index]
+			if stmt.Offset != tt.offset || stmt.Line != tt.line || stmt.Column != tt.column {
+				t.Errorf("statement %d at offset %d, line %d, column %d, want %d, %d, %d",
+					tt.index, stmt.Offset, stmt.Line, stmt.Column, tt.offset, tt.line, tt.column)
+			}
+		})
+	}
+}
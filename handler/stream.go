@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pouyatavakoli/QueryLab/db"
+)
+
+// NDJSON streaming of query results. Every statement produces a header
+// line with its columns, one line per row and a result line with its
+// stats; a trailer line closes the response:
+//
+//	{"type":"header","index":0,"statement":"SELECT ...","columns":[...]}
+//	{"type":"row","values":[1,"Smith"]}
+//	{"type":"result","index":0,"command_tag":"SELECT 1",...}
+//	{"type":"trailer","query_id":"4f1c...","statements":1,"duration_ms":4.2}
+//
+// A statement that fails before returning columns has no header line.
+
+const ndjsonContentType = "application/x-ndjson"
+
+// streamFlushRows is how many rows are buffered before flushing to the client
+const streamFlushRows = 100
+
+type streamHeader struct {
+	Type      string   `json:"type"`
+	Index     int      `json:"index"`
+	Statement string   `json:"statement"`
+	Columns   []Column `json:"columns"`
+}
+
+type streamRow struct {
+	Type   string        `json:"type"`
+	Values []interface{} `json:"values"`
+}
+
+type streamResult struct {
+	Type          string      `json:"type"`
+	Index         int         `json:"index"`
+	StatementType string      `json:"statement_type"`
+	CommandTag    string      `json:"command_tag,omitempty"`
+	RowsAffected  int64       `json:"rows_affected"`
+	RowCount      int         `json:"row_count"` // rows streamed for this statement
+	DurationMs    float64     `json:"duration_ms"`
+	Truncated     bool        `json:"truncated,omitempty"`
+	LimitType     string      `json:"limit_type,omitempty"`
+	Limit         int64       `json:"limit,omitempty"`
+	Error         string      `json:"error,omitempty"`
+	ErrorDetail   *QueryError `json:"error_detail,omitempty"`
+	Notices       []Notice    `json:"notices,omitempty"`
+}
+
+type streamTrailer struct {
+	Type       string  `json:"type"`
+	QueryID    string  `json:"query_id"`
+	Statements int     `json:"statements"` // statements that ran
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+	Stateful   bool    `json:"stateful"`
+	TxStatus   string  `json:"transaction_status,omitempty"`
+}
+
+// wantsStream reports whether the client asked for NDJSON, with an Accept
+// header or the stream query parameter
+func wantsStream(r *http.Request) bool {
+	if stream, err := strconv.ParseBool(r.URL.Query().Get("stream")); err == nil {
+		return stream
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// ndjsonWriter writes rows to the response as they are read
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	index   int // index of the current statement
+	pending int // rows written since the last flush
+}
+
+func newNDJSONWriter(w http.ResponseWriter) *ndjsonWriter {
+	return &ndjsonWriter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (n *ndjsonWriter) flush() {
+	if f, ok := n.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	n.pending = 0
+}
+
+func (n *ndjsonWriter) begin(res *StatementResult) error {
+	err := n.enc.Encode(streamHeader{
+		Type:      "header",
+		Index:     n.index,
+		Statement: res.Statement,
+		Columns:   res.Columns,
+	})
+	n.flush()
+	return err
+}
+
+func (n *ndjsonWriter) row(res *StatementResult, values []interface{}) error {
+	if err := n.enc.Encode(streamRow{Type: "row", Values: values}); err != nil {
+		return err
+	}
+	if n.pending++; n.pending >= streamFlushRows {
+		n.flush()
+	}
+	return nil
+}
+
+func (n *ndjsonWriter) end(res *StatementResult) error {
+	err := n.enc.Encode(streamResult{
+		Type:          "result",
+		Index:         n.index,
+		StatementType: res.StatementType,
+		CommandTag:    res.CommandTag,
+		RowsAffected:  res.RowsAffected,
+		RowCount:      res.numRows,
+		DurationMs:    res.DurationMs,
+		Truncated:     res.Truncated,
+		LimitType:     res.LimitType,
+		Limit:         res.Limit,
+		Error:         res.Error,
+		ErrorDetail:   res.ErrorDetail,
+		Notices:       res.Notices,
+	})
+	n.flush()
+	n.index++
+	return err
+}
+
+// streamQuery runs a script and streams its results as NDJSON
+func (h *Handler) streamQuery(ctx context.Context, w http.ResponseWriter, sc *db.SessionConn, stmts []statement, sessionID, queryID string, start time.Time) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	nw := newNDJSONWriter(w)
+	trailer := streamTrailer{Type: "trailer", QueryID: queryID, Stateful: sc.Stateful}
+
+	if len(stmts) == 0 {
+		trailer.Error = "query is empty"
+		trailer.TxStatus = sc.TxStatus(ctx)
+		nw.enc.Encode(trailer)
+		return
+	}
+
+	results, err := runScript(ctx, sc.Conn, stmts, newResultBudget(h.Options), nw, sessionID)
+	if err != nil {
+		slog.Warn("Failed to stream query results",
+			"session_id", sessionID,
+			"error", err,
+		)
+		return
+	}
+
+	last := results[len(results)-1]
+	trailer.Statements = len(results)
+	trailer.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	trailer.Error = last.Error
+	trailer.TxStatus = sc.TxStatus(ctx)
+
+	slog.Info("Query streamed",
+		"session_id", sessionID,
+		"query_id", queryID,
+		"num_statements", len(results),
+		"command_tag", last.CommandTag,
+		"num_rows", last.numRows,
+		"truncated", last.Truncated,
+		"duration", time.Since(start),
+	)
+
+	nw.enc.Encode(trailer)
+}
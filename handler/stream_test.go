@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWantsStream(t *testing.T) {
+	tests := []struct {
+		url    string
+		accept string
+		want   bool
+	}{
+		{"/api/query", "", false},
+		{"/api/query", "application/json", false},
+		{"/api/query", "application/x-ndjson", true},
+		{"/api/query", "application/json, application/x-ndjson; q=0.9", true},
+		{"/api/query", "application/x-ndjsonx", false},
+		{"/api/query?stream=1", "", true},
+		{"/api/query?stream=true", "application/json", true},
+		{"/api/query?stream=0", "application/x-ndjson", false},
+		{"/api/query?stream=maybe", "application/x-ndjson", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.url, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := wantsStream(r); got != tt.want {
+			t.Errorf("wantsStream(%s, Accept %q) = %v, want %v", tt.url, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestNDJSONWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	nw := newNDJSONWriter(rec)
+
+	first := &StatementResult{
+		Statement: "SELECT id FROM t",
+		Columns:   []Column{{Name: "id", Type: "INT4"}},
+	}
+	if err := nw.begin(first); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		if err := nw.row(first, []interface{}{i}); err != nil {
+			t.Fatal(err)
+		}
+		first.numRows++
+	}
+	first.CommandTag, first.RowsAffected, first.StatementType = "SELECT 2", 2, stmtQuery
+	if err := nw.end(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// A statement failing before it returns columns has no header
+	second := &StatementResult{Statement: "SELEC", StatementType: stmtUtility, Error: "syntax error"}
+	if err := nw.end(second); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`{"type":"header","index":0,"statement":"SELECT id FROM t","columns":[{"name":"id","type":"INT4"}]}`,
+		`{"type":"row","values":[0]}`,
+		`{"type":"row","values":[1]}`,
+		`{"type":"result","index":0,"statement_type":"query","command_tag":"SELECT 2","rows_affected":2,"row_count":2,"duration_ms":0}`,
+		`{"type":"result","index":1,"statement_type":"utility","rows_affected":0,"row_count":0,"duration_ms":0,"error":"syntax error"}`,
+	}
+	got := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(got), len(want), rec.Body.String())
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d = %s, want %s", i, got[i], want[i])
+		}
+		if !json.Valid([]byte(got[i])) {
+			t.Errorf("line %d is not JSON: %s", i, got[i])
+		}
+	}
+	if !rec.Flushed {
+		t.Error("rows were not flushed to the client")
+	}
+}
+
+func TestNDJSONWriterFlushesInBatches(t *testing.T) {
+	rec := httptest.NewRecorder()
+	nw := newNDJSONWriter(rec)
+	res := &StatementResult{}
+
+	for range streamFlushRows - 1 {
+		nw.row(res, []interface{}{1})
+	}
+	if rec.Flushed {
+		t.Fatalf("flushed before %d rows", streamFlushRows)
+	}
+	nw.row(res, []interface{}{1})
+	if !rec.Flushed || nw.pending != 0 {
+		t.Errorf("not flushed after %d rows, %d pending", streamFlushRows, nw.pending)
+	}
+}
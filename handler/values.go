@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column describes a result column
+type Column struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`                // database type name, e.g. NUMERIC, VARCHAR, _INT4 for int4[]
+	Precision *int64 `json:"precision,omitempty"` // numeric precision
+	Scale     *int64 `json:"scale,omitempty"`     // numeric scale
+	Length    *int64 `json:"length,omitempty"`    // declared length of varchar/char columns
+	Nullable  *bool  `json:"nullable,omitempty"`  // whether the table column it comes from allows NULL, unset for computed columns
+}
+
+// columnsOf reads the column metadata lib/pq exposes on driver rows.
+// nullable holds the nullability of the columns, if known.
+func columnsOf(rows driver.Rows, nullable []*bool) []Column {
+	names := rows.Columns()
+	cols := make([]Column, len(names))
+
+	for i, name := range names {
+		col := Column{Name: name}
+		if i < len(nullable) {
+			col.Nullable = nullable[i]
+		}
+
+		if r, ok := rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+			col.Type = r.ColumnTypeDatabaseTypeName(i)
+		}
+		if r, ok := rows.(driver.RowsColumnTypePrecisionScale); ok {
+			// Unconstrained numerics come back with a bogus 0xffff precision
+			if precision, scale, ok := r.ColumnTypePrecisionScale(i); ok && precision > 0 && precision < 0xffff {
+				col.Precision, col.Scale = &precision, &scale
+			}
+		}
+		if r, ok := rows.(driver.RowsColumnTypeLength); ok {
+			// text and bytea report MaxInt64, unbounded varchar a negative length
+			if length, ok := r.ColumnTypeLength(i); ok && length > 0 && length != math.MaxInt64 {
+				col.Length = &length
+			}
+		}
+
+		cols[i] = col
+	}
+	return cols
+}
+
+// maxExactInt is the largest integer a JSON number holds exactly in
+// JavaScript, 2^53
+const maxExactInt = 1 << 53
+
+// encodeValue converts a driver value into its JSON form based on the
+// column type: decimals and bigints beyond 2^53 stay exact strings, dates use ISO 8601,
+// bytea is base64 and arrays and json become native JSON
+func encodeValue(v driver.Value, typeName string) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case int64:
+		// JSON numbers lose precision beyond 2^53, those bigints stay strings
+		if typeName == "INT8" && (val > maxExactInt || val < -maxExactInt) {
+			return strconv.FormatInt(val, 10)
+		}
+		return val
+	case float64:
+		return encodeFloat(val)
+	case time.Time:
+		return encodeTime(val, typeName)
+	case []byte:
+		switch {
+		case typeName == "BYTEA":
+			return base64.StdEncoding.EncodeToString(val)
+		case typeName == "JSON" || typeName == "JSONB":
+			if json.Valid(val) {
+				return json.RawMessage(val)
+			}
+			return string(val)
+		case strings.HasPrefix(typeName, "_"):
+			if arr, ok := parseArray(string(val), strings.TrimPrefix(typeName, "_")); ok {
+				return arr
+			}
+			return string(val)
+		default:
+			return string(val)
+		}
+	default:
+		return val
+	}
+}
+
+// encodeFloat keeps NaN and infinities, which JSON numbers can't hold, as strings
+func encodeFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
+
+func encodeTime(t time.Time, typeName string) string {
+	switch typeName {
+	case "DATE":
+		return t.Format("2006-01-02")
+	case "TIMESTAMP":
+		return t.Format("2006-01-02T15:04:05.999999")
+	case "TIME":
+		return t.Format("15:04:05.999999")
+	case "TIMETZ":
+		return t.Format("15:04:05.999999Z07:00")
+	default:
+		return t.Format(time.RFC3339Nano)
+	}
+}
+
+// encodeElement converts one array element from its text form
+func encodeElement(s string, elemType string) interface{} {
+	switch elemType {
+	case "INT2", "INT4", "OID":
+		return json.Number(s)
+	case "INT8":
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && n <= maxExactInt && n >= -maxExactInt {
+			return json.Number(s)
+		}
+		return s
+	case "BYTEA":
+		// Elements come in the hex output format, \x0102
+		if digits, ok := strings.CutPrefix(s, `\x`); ok {
+			if b, err := hex.DecodeString(digits); err == nil {
+				return base64.StdEncoding.EncodeToString(b)
+			}
+		}
+		return s
+	case "FLOAT4", "FLOAT8":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return encodeFloat(f)
+		}
+		return s
+	case "BOOL":
+		return s == "t" || s == "true"
+	case "JSON", "JSONB":
+		if json.Valid([]byte(s)) {
+			return json.RawMessage(s)
+		}
+		return s
+	}
+	// NUMERIC stays a string to keep its exact value, like everything else
+	return s
+}
+
+// parseArray parses a PostgreSQL array literal such as {1,2,NULL} or
+// {{"a b",c},{d,e}} into nested slices
+func parseArray(s, elemType string) ([]interface{}, bool) {
+	// Arrays with non-default bounds carry a "[1:2]=" prefix
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return nil, false
+		}
+		s = s[i+1:]
+	}
+
+	p := arrayParser{s: s, elemType: elemType}
+	arr, ok := p.parse()
+	if !ok || p.pos != len(p.s) {
+		return nil, false
+	}
+	return arr, true
+}
+
+type arrayParser struct {
+	s        string
+	pos      int
+	elemType string
+}
+
+func (p *arrayParser) parse() ([]interface{}, bool) {
+	if p.pos >= len(p.s) || p.s[p.pos] != '{' {
+		return nil, false
+	}
+	p.pos++
+
+	out := []interface{}{}
+	if p.pos < len(p.s) && p.s[p.pos] == '}' {
+		p.pos++
+		return out, true
+	}
+
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case '{':
+			sub, ok := p.parse()
+			if !ok {
+				return nil, false
+			}
+			out = append(out, sub)
+		case '"':
+			str, ok := p.quoted()
+			if !ok {
+				return nil, false
+			}
+			out = append(out, encodeElement(str, p.elemType))
+		default:
+			start := p.pos
+			for p.pos < len(p.s) && p.s[p.pos] != ',' && p.s[p.pos] != '}' {
+				p.pos++
+			}
+			raw := strings.TrimSpace(p.s[start:p.pos])
+			if strings.EqualFold(raw, "NULL") {
+				out = append(out, nil)
+			} else {
+				out = append(out, encodeElement(raw, p.elemType))
+			}
+		}
+
+		if p.pos >= len(p.s) {
+			return nil, false
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return out, true
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// quoted reads a double-quoted element, undoing backslash escapes
+func (p *arrayParser) quoted() (string, bool) {
+	var b strings.Builder
+	p.pos++
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch c {
+		case '\\':
+			if p.pos+1 >= len(p.s) {
+				return "", false
+			}
+			b.WriteByte(p.s[p.pos+1])
+			p.pos += 2
+		case '"':
+			p.pos++
+			return b.String(), true
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", false
+}
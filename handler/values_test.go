@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseArray(t *testing.T) {
+	tests := []struct {
+		name     string
+		literal  string
+		elemType string
+		want     []interface{}
+		ok       bool
+	}{
+		{"empty", "{}", "INT4", []interface{}{}, true},
+		{"integers with null", "{1,2,NULL}", "INT4", []interface{}{json.Number("1"), json.Number("2"), nil}, true},
+		{"bigints", "{42,-9007199254740992}", "INT8", []interface{}{json.Number("42"), json.Number("-9007199254740992")}, true},
+		{"bigints beyond 2^53 stay strings", "{9007199254740993,-9007199254740993}", "INT8", []interface{}{"9007199254740993", "-9007199254740993"}, true},
+		{"floats", "{1.5,NaN,-Infinity}", "FLOAT8", []interface{}{1.5, "NaN", "-Infinity"}, true},
+		{"booleans", "{t,f}", "BOOL", []interface{}{true, false}, true},
+		{"numeric stays exact", "{1.10,2.00}", "NUMERIC", []interface{}{"1.10", "2.00"}, true},
+		{"quoted text", `{"a b",c,"d,e"}`, "TEXT", []interface{}{"a b", "c", "d,e"}, true},
+		{"escapes", `{"say \"hi\"","back\\slash"}`, "TEXT", []interface{}{`say "hi"`, `back\slash`}, true},
+		{"quoted null is text", `{"NULL",NULL}`, "TEXT", []interface{}{"NULL", nil}, true},
+		{"bytea", `{"\\x0102","\\x"}`, "BYTEA", []interface{}{"AQI=", ""}, true},
+		{"json", `{"{\"a\": 1}"}`, "JSONB", []interface{}{json.RawMessage(`{"a": 1}`)}, true},
+		{"nested", `{{1,2},{3,4}}`, "INT4", []interface{}{
+			[]interface{}{json.Number("1"), json.Number("2")},
+			[]interface{}{json.Number("3"), json.Number("4")},
+		}, true},
+		{"bounds", "[0:1]={1,2}", "INT4", []interface{}{json.Number("1"), json.Number("2")}, true},
+		{"unterminated", "{1,2", "INT4", nil, false},
+		{"trailing text", "{1}x", "INT4", nil, false},
+		{"unterminated quote", `{"a}`, "TEXT", nil, false},
+		{"not an array", "1,2", "INT4", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseArray(tt.literal, tt.elemType)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseArray(%q, %q) = %#v, %v, want %#v, %v", tt.literal, tt.elemType, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	date := time.Date(2024, 3, 1, 13, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		value    driver.Value
+		typeName string
+		want     interface{}
+	}{
+		{"null", nil, "INT4", nil},
+		{"int4", int64(5), "INT4", int64(5)},
+		{"int8", int64(9007199254740992), "INT8", int64(9007199254740992)},
+		{"int8 above 2^53", int64(9007199254740993), "INT8", "9007199254740993"},
+		{"int8 below -2^53", int64(-9007199254740993), "INT8", "-9007199254740993"},
+		{"numeric", []byte("1.50"), "NUMERIC", "1.50"},
+		{"bytea", []byte{1, 2}, "BYTEA", "AQI="},
+		{"json", []byte(`{"a":1}`), "JSON", json.RawMessage(`{"a":1}`)},
+		{"invalid json", []byte(`{`), "JSON", "{"},
+		{"array", []byte("{1,2}"), "_INT4", []interface{}{json.Number("1"), json.Number("2")}},
+		{"malformed array", []byte("{1,"), "_INT4", "{1,"},
+		{"date", date, "DATE", "2024-03-01"},
+		{"timestamp", date, "TIMESTAMP", "2024-03-01T13:04:05"},
+		{"nan", nan(), "FLOAT8", "NaN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := encodeValue(tt.value, tt.typeName)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("encodeValue(%#v, %q) = %#v, want %#v", tt.value, tt.typeName, got, tt.want)
+			}
+		})
+	}
+}
+
+func nan() float64 {
+	var zero float64
+	return zero / zero
+}
@@ -1,3 +1,6 @@
+-- name: Company
+-- description: Employees, departments, projects and dependents (Elmasri & Navathe COMPANY schema)
+-- difficulty: beginner
 -- write db base here 
 CREATE TABLE EMPLOYEE (
     Fname VARCHAR(15) NOT NULL,